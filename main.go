@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"iter"
+	"log"
 	"net/http"
-	"sync"
 	"time"
 
 	"github.com/a-h/templ"
+	"github.com/zackarysantana/goview/stream"
 	"github.com/zackarysantana/goview/templates"
 )
 
@@ -34,99 +37,182 @@ import (
 // 	return ProjectData{}, nil
 // }
 
-func main() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Create a channel to send data to the template.
-		data := make(chan templ.Component)
-		// Run a background process that will take 10 seconds to complete.
-		go func() {
-			// Always remember to close the channel.
-			wg := sync.WaitGroup{}
-			wg.Add(5)
-			defer func() {
-				wg.Wait()
-				close(data)
-			}()
-			sleepTimeSecs := []int{4, 2, 0, 1, 1}
-			for i := 1; i <= 5; i++ {
-				go func() {
-					defer wg.Done()
-					time.Sleep(time.Duration(sleepTimeSecs[i-1]) * time.Second)
-
-					select {
-					case <-r.Context().Done():
-						// Quit early if the client is no longer connected.
-						return
-					case <-time.After(time.Second):
-						// Send a new piece of data to the channel.
-						data <- templates.Slot(i)
-					}
-				}()
-			}
-		}()
+// sleep pauses for d, returning early if ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-		// Pass the channel to the template.
-		component := templates.Root(data)
+// The slots of each page, declared once so that a misspelt name does not
+// compile.
+var (
+	numbered = [...]stream.Key[struct{}]{
+		stream.NewKey[struct{}]("slot-1"),
+		stream.NewKey[struct{}]("slot-2"),
+		stream.NewKey[struct{}]("slot-3"),
+		stream.NewKey[struct{}]("slot-4"),
+		stream.NewKey[struct{}]("slot-5"),
+	}
+	counting = stream.NewKey[struct{}]("numbers")
+	clock    = stream.NewKey[struct{}]("clock")
+
+	sidebar = stream.NewKey[struct{}]("a")
+	content = stream.NewKey[struct{}]("b")
+	details = stream.NewKey[struct{}]("b-details")
+	footer  = stream.NewKey[struct{}]("c")
+)
 
-		// Serve using the streaming mode of the handler.
-		templ.Handler(component, templ.WithStreaming()).ServeHTTP(w, r)
+func main() {
+	// Crawlers, link checkers and curl get a complete document instead of a
+	// stream, as does anyone asking for ?render=buffered.
+	modes := stream.WithModeRules(
+		stream.QueryMode("render"),
+		stream.UserAgentMode(stream.Buffered, "bot", "crawler", "spider"),
+		stream.AcceptMode(stream.Buffered),
+	)
+
+	// Every page shares one pool of producers, so a burst of requests cannot
+	// fan out into unbounded work.
+	sched := stream.NewScheduler(16).
+		Quota("/", 8).
+		Quota("/test", 8)
+	metrics := stream.NewMetrics().WatchScheduler(sched)
+
+	// The numbered slots rarely change, so they are served from the cache and
+	// refreshed in the background once they go stale.
+	cache := stream.NewCache(1024)
+	cachePolicy := stream.CachePolicy{TTL: 10 * time.Second, Stale: time.Minute}
+
+	// Each slot takes a different amount of time, so they arrive out of order.
+	root := stream.New(templates.Root,
+		stream.WithBudget(10*time.Second),
+		stream.WithScheduler(sched, "/"),
+		stream.WithMetrics(metrics, "/"),
+		stream.WithServerTiming(),
+		stream.WithWaterfall("debug"),
+		stream.WithStylesheets("/assets/styles.css"),
+		stream.WithCompression(),
+		stream.WithEarlyHints(),
+		// The numbered slots are listed above the others.
+		stream.WithShell(func(placeholder func(name string) templ.Component) templ.Component {
+			items := make([]templ.Component, len(numbered))
+			for i, key := range numbered {
+				items[i] = placeholder(key.Name())
+			}
+			return templ.Join(templates.List(items), placeholder(counting.Name()), placeholder(clock.Name()))
+		}),
+		modes,
+	)
+	// The numbered slots look their numbers up together: the keys every
+	// producer asks for within 10ms are loaded in a single query per request.
+	numbers := stream.NewLoader(10*time.Millisecond, func(ctx context.Context, keys []int) (map[int]int, error) {
+		if err := sleep(ctx, 200*time.Millisecond); err != nil {
+			return nil, err
+		}
+		values := make(map[int]int, len(keys))
+		for _, k := range keys {
+			values[k] = k
+		}
+		return values, nil
 	})
-
-	http.HandleFunc("/test", func(w http.ResponseWriter, r *http.Request) {
-		// Create a channel to send deferred component renders to the template.
-		data := make(chan templates.SlotContents)
-
-		// We know there are 3 slots, so start a WaitGround.
-		var wg sync.WaitGroup
-		wg.Add(3)
-
-		// Start the async processes.
-		// Sidebar.
-		go func() {
-			defer wg.Done()
-			time.Sleep(time.Second * 3)
-			data <- templates.SlotContents{
-				Name:     "a",
-				Contents: templates.A(),
+	sleepTimeSecs := []int{4, 2, 0, 1, 1}
+	for i, key := range numbered {
+		stream.SlotFor(root, key, func(ctx context.Context) (templ.Component, error) {
+			num, err := numbers.Load(ctx, i+1)
+			if err != nil {
+				return nil, err
 			}
-		}()
-
-		// Content.
-		go func() {
-			defer wg.Done()
-			time.Sleep(time.Second * 2)
-			data <- templates.SlotContents{
-				Name:     "b",
-				Contents: templates.B(),
+			if err := sleep(ctx, time.Duration(sleepTimeSecs[i])*time.Second); err != nil {
+				return nil, err
 			}
-		}()
-
-		// Footer.
-		go func() {
-			defer wg.Done()
-			time.Sleep(time.Second * 1)
-			data <- templates.SlotContents{
-				Name:     "c",
-				Contents: templates.C(),
+			return templates.Slot(num), nil
+		}, stream.WithCache(cache, cachePolicy), stream.WithPlaceholder(templates.SkeletonText(1)))
+	}
+	// The numbers are flushed one at a time as they are counted.
+	stream.ListFor(root, counting, func(ctx context.Context) iter.Seq2[templ.Component, error] {
+		return func(yield func(templ.Component, error) bool) {
+			for i := 1; i <= 100; i++ {
+				if err := sleep(ctx, 50*time.Millisecond); err != nil {
+					yield(nil, err)
+					return
+				}
+				if !yield(templates.Slot(i), nil) {
+					return
+				}
 			}
-		}()
-
-		// Close the channel when all processes are done.
-		go func() {
-			wg.Wait()
-			close(data)
-		}()
-
-		// Pass the channel to the template.
-		component := templates.Page(data)
-
-		// Serve using the streaming mode of the handler.
-		templ.Handler(component, templ.WithStreaming()).ServeHTTP(w, r)
-	})
+		}
+	}, stream.WithLimit(20), stream.WithPlaceholder(templates.SkeletonText(3)))
+	// The clock keeps ticking over Server-Sent Events once the page has loaded.
+	stream.SlotFor(root, clock, func(ctx context.Context) (templ.Component, error) {
+		return templates.Clock(time.Now()), nil
+	}, stream.WithUpdates(stream.Every(time.Second)), stream.WithPlaceholder(templates.SkeletonText(1)))
+	http.Handle("/", root)
+
+	// Concurrent visitors share one run of the sidebar and footer.
+	group := stream.NewGroup()
+
+	page := stream.New(templates.Page,
+		// The content's details keep streaming after it, which Shadow mode
+		// would hold the sidebar and footer back behind.
+		stream.WithMode(stream.Script),
+		stream.WithBudget(10*time.Second),
+		stream.WithScheduler(sched, "/test"),
+		stream.WithMetrics(metrics, "/test"),
+		stream.WithServerTiming(),
+		stream.WithWaterfall("debug"),
+		stream.WithStylesheets("/assets/styles.css"),
+		stream.WithCompression(),
+		stream.WithEarlyHints(),
+		modes,
+	)
+	stream.SlotFor(page, sidebar, func(ctx context.Context) (templ.Component, error) {
+		if err := sleep(ctx, time.Second*3); err != nil {
+			return nil, err
+		}
+		return templates.A(), nil
+	}, stream.WithCoalescing(group, nil), stream.WithPlaceholder(templates.SkeletonList(3)))
+	stream.SlotFor(page, content, func(ctx context.Context) (templ.Component, error) {
+		if err := sleep(ctx, time.Second*2); err != nil {
+			return nil, err
+		}
+		// The details keep streaming after the content has been flushed.
+		more := details.Nest(ctx, func(ctx context.Context) (templ.Component, error) {
+			if err := sleep(ctx, time.Second*2); err != nil {
+				return nil, err
+			}
+			return templates.Details(), nil
+		}, stream.WithPlaceholder(templates.SkeletonBlock("h-16 w-full")))
+		return templ.Join(templates.Title("Page: B"), templates.B(more)), nil
+	}, stream.WithSubSlots(details), stream.WithPlaceholder(templates.SkeletonText(3)))
+	// The footer describes the sidebar, so it never arrives before it.
+	stream.SlotFor(page, footer, func(ctx context.Context) (templ.Component, error) {
+		if err := sleep(ctx, time.Second*1); err != nil {
+			return nil, err
+		}
+		return templates.C(), nil
+	}, stream.DependsOn(sidebar), stream.WithCoalescing(group, nil), stream.WithPlaceholder(templates.SkeletonText(1)))
+	http.Handle("/test", page)
+
+	// Every slot can also be fetched on its own, so htmx can refresh a single
+	// section, e.g. hx-get="/slot/slot-1" hx-trigger="every 30s".
+	http.Handle("/slot/", root.Partials("/slot/"))
+	http.Handle("/test/slot/", page.Partials("/test/slot/"))
 
 	http.Handle("/assets/",
 		http.StripPrefix("/assets",
 			http.FileServer(http.Dir("assets"))))
+	http.Handle("/metrics", metrics)
+
+	// Fail fast if a slot is miswired, rather than leave it loading forever.
+	for path, s := range map[string]*stream.Stream{"/": root, "/test": page} {
+		if err := s.Validate(); err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
+	}
 
 	fmt.Println("Listening on :3000 (the proxy is on :7331)")
 	http.ListenAndServe(":3000", nil)
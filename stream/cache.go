@@ -0,0 +1,215 @@
+package stream
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/a-h/templ"
+)
+
+// refreshTimeout bounds a background refresh of a slot without a timeout.
+const refreshTimeout = time.Minute
+
+// CachePolicy controls how a slot's results are cached.
+type CachePolicy struct {
+	// TTL is how long a result is served without recomputing it.
+	TTL time.Duration
+	// Stale is how long after its TTL a result is still served immediately,
+	// while a background refresh recomputes it.
+	Stale time.Duration
+	// Params returns the request parameters that the slot's result depends on.
+	// When nil, every request shares the same result.
+	Params func(r *http.Request) string
+}
+
+// QueryParams returns a CachePolicy.Params function that keys results on the
+// named query parameters, encoded as by url.Values.Encode.
+func QueryParams(names ...string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		q := r.URL.Query()
+		v := make(url.Values, len(names))
+		for _, name := range names {
+			if vs, ok := q[name]; ok {
+				v[name] = vs
+			}
+		}
+		return v.Encode()
+	}
+}
+
+// WithCache caches the slot's successful results in c, keyed by the slot's
+// name and the request parameters chosen by p. Results that nest sub-slots are
+// never cached.
+func WithCache(c *Cache, p CachePolicy) SlotOption {
+	return func(sl *slot) {
+		sl.cache = c
+		sl.cachePolicy = p
+	}
+}
+
+// Cache stores slot results across requests. It is safe for concurrent use.
+type Cache struct {
+	limit int
+	// now is the cache's clock, replaced in tests.
+	now func() time.Time
+
+	mu         sync.Mutex
+	entries    map[string]*cached
+	refreshing map[string]bool
+}
+
+type cached struct {
+	contents templ.Component
+	value    any
+	fresh    time.Time
+	expires  time.Time
+}
+
+// NewCache creates a Cache that holds at most limit results. When it is full,
+// the result closest to expiring is evicted.
+func NewCache(limit int) *Cache {
+	return &Cache{
+		limit:      limit,
+		now:        time.Now,
+		entries:    make(map[string]*cached),
+		refreshing: make(map[string]bool),
+	}
+}
+
+// Invalidate removes the result of the named slot for params, as returned by
+// its CachePolicy.Params.
+func (c *Cache) Invalidate(name, params string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, cacheKey(name, params))
+}
+
+// InvalidateSlot removes every result of the named slot.
+func (c *Cache) InvalidateSlot(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefix := cacheKey(name, "")
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Clear removes every result.
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+}
+
+func cacheKey(name, params string) string {
+	return name + "\x00" + params
+}
+
+// slotKey returns the key of the named slot for r, whose parameters are chosen
+// by params.
+func slotKey(name string, params func(r *http.Request) string, r *http.Request) string {
+	var p string
+	if params != nil && r != nil {
+		p = params(r)
+	}
+	return cacheKey(name, p)
+}
+
+// lookup returns the result stored under key, and whether it is still fresh.
+func (c *Cache) lookup(key string) (*cached, bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false, false
+	}
+	now := c.now()
+	if !now.Before(e.expires) {
+		delete(c.entries, key)
+		return nil, false, false
+	}
+	return e, now.Before(e.fresh), true
+}
+
+// store records a result under key.
+func (c *Cache) store(key string, p CachePolicy, contents templ.Component, value any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.limit {
+		c.evict()
+	}
+	now := c.now()
+	c.entries[key] = &cached{
+		contents: contents,
+		value:    value,
+		fresh:    now.Add(p.TTL),
+		expires:  now.Add(p.TTL + p.Stale),
+	}
+}
+
+// evict removes the result closest to expiring.
+func (c *Cache) evict() {
+	var oldest string
+	var expires time.Time
+	for key, e := range c.entries {
+		if oldest == "" || e.expires.Before(expires) {
+			oldest, expires = key, e.expires
+		}
+	}
+	delete(c.entries, oldest)
+}
+
+// startRefresh reports whether the caller should refresh key, which is the
+// case unless a refresh is already running.
+func (c *Cache) startRefresh(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refreshing[key] {
+		return false
+	}
+	c.refreshing[key] = true
+	return true
+}
+
+func (c *Cache) endRefresh(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.refreshing, key)
+}
+
+// revalidate recomputes a stale result in the background. The refresh outlives
+// the request on purpose, so it is bounded by the slot's timeout instead.
+func (r *run) revalidate(ctx context.Context, sl slot, key string) {
+	if !sl.cache.startRefresh(key) {
+		return
+	}
+	timeout := sl.timeout
+	if timeout <= 0 {
+		timeout = refreshTimeout
+	}
+	// The refresh has loads of its own, whose batches the request does not wait
+	// for either.
+	e := newEntry()
+	ctx, nested := r.detached(withLoads(context.WithoutCancel(ctx), nil), e)
+
+	go func() {
+		defer sl.cache.endRefresh(key)
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		res := r.invoke(ctx, sl)
+		if res.err != nil {
+			log.Printf("stream: refreshing slot %q failed: %v", sl.name, res.err)
+			return
+		}
+		if !nested() {
+			sl.cache.store(key, sl.cachePolicy, res.contents, e.get())
+		}
+	}()
+}
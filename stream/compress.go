@@ -0,0 +1,136 @@
+package stream
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// WithCompression compresses pages and partials with brotli or gzip, whichever
+// the client prefers. The compressor is flushed along with the response, so
+// each slot still reaches the client as soon as it is ready.
+func WithCompression() Option {
+	return func(s *Stream) {
+		s.compression = true
+	}
+}
+
+// compressor is implemented by gzip.Writer and brotli.Writer.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressWriter compresses a response as it is written.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	started  bool
+	// enc is nil until the response is started, and stays nil if the
+	// Content-Encoding header was dropped by then, as http.Error does.
+	enc compressor
+}
+
+func (w *compressWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	h := w.Header()
+	if h.Get("Content-Encoding") != w.encoding {
+		return
+	}
+	h.Del("Content-Length")
+	switch w.encoding {
+	case "br":
+		w.enc = brotli.NewWriter(w.ResponseWriter)
+	case "gzip":
+		w.enc = gzip.NewWriter(w.ResponseWriter)
+	}
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	w.start()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	w.start()
+	if w.enc == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.enc.Write(p)
+}
+
+// Flush implements http.Flusher, flushing the compressor first.
+func (w *compressWriter) Flush() {
+	if w.enc != nil {
+		if err := w.enc.Flush(); err != nil {
+			return
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying http.ResponseWriter for http.ResponseController.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close writes the end of the compressed response.
+func (w *compressWriter) close() error {
+	if w.enc == nil {
+		return nil
+	}
+	return w.enc.Close()
+}
+
+// compress wraps w to compress the response to r, if the stream compresses
+// responses and r accepts an encoding it supports. done must be called once the
+// response has been written.
+func (s *Stream) compress(w http.ResponseWriter, r *http.Request) (cw http.ResponseWriter, done func()) {
+	if !s.compression {
+		return w, func() {}
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	encoding := negotiate(r.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return w, func() {}
+	}
+	w.Header().Set("Content-Encoding", encoding)
+	c := &compressWriter{ResponseWriter: w, encoding: encoding}
+	return c, func() { c.close() }
+}
+
+// negotiate picks brotli or gzip, whichever accept gives the higher quality, or
+// returns "" if it accepts neither. Brotli wins a tie.
+func negotiate(accept string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "br" && name != "gzip" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ || q == bestQ && name == "br" {
+			best, bestQ = name, q
+		}
+	}
+	if bestQ <= 0 {
+		return ""
+	}
+	return best
+}
@@ -0,0 +1,116 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// errNestedShared is returned by a coalesced slot whose producer nested
+// sub-slots, which only exist in the request that declared them.
+var errNestedShared = errors.New("stream: a coalesced slot cannot nest sub-slots")
+
+// WithCoalescing shares one run of the slot's producer between concurrent
+// requests that agree on its name and the request parameters chosen by params,
+// which may be nil. Each request still flushes the result into its own stream
+// and stops waiting when its own context is done; the shared run is only
+// cancelled once every request waiting for it has gone.
+//
+// The shared run cannot nest sub-slots, and reads the values of the first
+// request's dependencies.
+func WithCoalescing(g *Group, params func(r *http.Request) string) SlotOption {
+	return func(sl *slot) {
+		sl.group = g
+		sl.groupParams = params
+	}
+}
+
+// Group coalesces identical in-flight slot computations. It is safe for
+// concurrent use.
+type Group struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+// flight is a shared run of a producer.
+type flight struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+
+	res   result
+	value any
+}
+
+// NewGroup creates an empty Group.
+func NewGroup() *Group {
+	return &Group{calls: make(map[string]*flight)}
+}
+
+// do returns the result of fn for key, joining a run already in flight if
+// there is one. fn runs detached from ctx, and is cancelled once every caller
+// waiting for it has stopped.
+func (g *Group) do(ctx context.Context, key string, fn func(ctx context.Context) (result, any)) (result, any) {
+	g.mu.Lock()
+	f, ok := g.calls[key]
+	if !ok {
+		fctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = f
+		go func() {
+			defer cancel()
+			f.res, f.value = fn(fctx)
+			g.forget(key, f)
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.res, f.value
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// Later callers start afresh rather than join a cancelled run. The
+			// run is forgotten before the lock is released, so that none can
+			// join it in between.
+			if g.calls[key] == f {
+				delete(g.calls, key)
+			}
+			f.cancel()
+		}
+		g.mu.Unlock()
+		return result{err: ctx.Err()}, nil
+	}
+}
+
+// forget removes f from the calls in flight, unless it has been replaced.
+func (g *Group) forget(key string, f *flight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.calls[key] == f {
+		delete(g.calls, key)
+	}
+}
+
+// callShared runs sl's producer through its Group.
+func (r *run) callShared(ctx context.Context, sl slot, e *entry) result {
+	key := slotKey(sl.name, sl.groupParams, Request(ctx))
+	res, value := sl.group.do(ctx, key, func(ctx context.Context) (result, any) {
+		// The shared run has an entry and loads of its own, rather than touch
+		// the slots of the request that started it, which it may outlive.
+		se := newEntry()
+		ctx, nested := r.detached(withLoads(ctx, nil), se)
+		res := r.invoke(ctx, sl)
+		if nested() && res.err == nil {
+			res = result{err: errNestedShared}
+		}
+		return res, se.get()
+	})
+	e.set(value)
+	return res
+}
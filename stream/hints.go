@@ -0,0 +1,41 @@
+package stream
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/zackarysantana/goview/templates"
+)
+
+// AssetLayout is a Layout that declares the assets it loads, such as a
+// templates.Document. They are hinted to the browser so that it can fetch them
+// while the shell is still being rendered.
+type AssetLayout interface {
+	Layout
+	Assets() []templates.Asset
+}
+
+// WithEarlyHints also sends the layout's assets ahead of the page, before any
+// producer starts, in a 103 Early Hints response to clients that speak
+// HTTP/1.1 or later. It is off by default, because not every ResponseWriter
+// accepts a 1xx response before the page: httptest.ResponseRecorder, for one,
+// takes it for the page's status.
+func WithEarlyHints() Option {
+	return func(s *Stream) {
+		s.earlyHints = true
+	}
+}
+
+// hint preloads the layout's assets with Link headers on the page's own
+// headers, and ahead of the page in a 103 Early Hints response if enabled.
+func (s *Stream) hint(w http.ResponseWriter, r *http.Request) {
+	if len(s.assets) == 0 {
+		return
+	}
+	for _, a := range s.assets {
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=preload; as=%s", a.Href, a.As))
+	}
+	if s.earlyHints && r.ProtoAtLeast(1, 1) {
+		w.WriteHeader(http.StatusEarlyHints)
+	}
+}
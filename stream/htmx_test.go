@@ -0,0 +1,231 @@
+package stream
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/zackarysantana/goview/templates"
+)
+
+// browser makes the browser tests fail, rather than skip, without a Chrome to
+// run them in. make test/browser sets it.
+var browser = flag.Bool("browser", false, "fail the browser tests if no Chrome is found")
+
+// findChrome returns the path of a headless-capable Chrome, from $CHROME or
+// the PATH, skipping the test if there is none.
+func findChrome(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("skipping browser test in short mode")
+	}
+	if path := os.Getenv("CHROME"); path != "" {
+		return path
+	}
+	for _, name := range []string{"chrome-headless-shell", "chromium", "chromium-browser", "google-chrome", "chrome"} {
+		if path, err := exec.LookPath(name); err == nil {
+			return path
+		}
+	}
+	if *browser {
+		t.Fatal("no Chrome found; set $CHROME to its path")
+	}
+	t.Skip("no Chrome found; set $CHROME to run browser tests")
+	return ""
+}
+
+// htmxLayout is a layout that loads htmx from the repository's assets.
+var htmxLayout = templates.Document{Meta: templates.PageMeta{Title: "Streaming"}}
+
+// pinger renders an element that asks htmx to GET /ping?id=id once processed.
+func pinger(id string) templ.Component {
+	return templ.Raw(fmt.Sprintf(`<div hx-get="/ping?id=%s" hx-trigger="load" hx-swap="outerHTML">Waiting for %s</div>`, id, id))
+}
+
+// pings records the ids pinged by the browser.
+type pings struct {
+	mu   sync.Mutex
+	seen map[string]bool
+	hit  chan struct{}
+}
+
+func (p *pings) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.seen[r.URL.Query().Get("id")] = true
+	p.mu.Unlock()
+	select {
+	case p.hit <- struct{}{}:
+	default:
+	}
+	fmt.Fprintf(w, "<p>Pinged %s</p>", r.URL.Query().Get("id"))
+}
+
+// await waits until every id has been pinged, or ctx is done.
+func (p *pings) await(ctx context.Context, ids ...string) bool {
+	for {
+		p.mu.Lock()
+		all := true
+		for _, id := range ids {
+			all = all && p.seen[id]
+		}
+		p.mu.Unlock()
+		if all {
+			return true
+		}
+		select {
+		case <-p.hit:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// TestHTMXProcessing checks, without a browser, that every streamed slot asks
+// htmx to process it as soon as it arrives. TestHTMXInStreamedSlots checks
+// that htmx then acts on it.
+func TestHTMXProcessing(t *testing.T) {
+	newStream := func(m Mode) *Stream {
+		return New(htmxLayout, WithMode(m)).
+			Slot("parent", func(ctx context.Context) (templ.Component, error) {
+				nested := Nest(ctx, "nested", after(0, pinger("nested")))
+				return templ.Join(pinger("parent"), nested), nil
+			}).
+			Slot("late", after(10*time.Millisecond, pinger("late")))
+	}
+
+	// In Shadow mode, each slot processes itself, including one with a
+	// shadow root of its own and the slot nested inside it.
+	w := httptest.NewRecorder()
+	newStream(Shadow).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	checkOrder(t, w.Body.String(),
+		"function goviewProcess(el)",
+		`<div slot="parent"><template shadowrootmode="open">`,
+		`</slot></template>`+processSlot,
+		`<div slot="nested">`,
+		`Waiting for nested</div> `+processSlot+`</div></div>`,
+		`<div slot="late">`,
+		`Waiting for late</div> `+processSlot+`</div>`,
+	)
+
+	// In Script mode, each chunk is processed once it has been moved into its
+	// placeholder.
+	w = httptest.NewRecorder()
+	newStream(Script).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	body := w.Body.String()
+	checkOrder(t, body,
+		"function goviewProcess(el)",
+		"function goviewSwap(name)",
+		"goviewProcess(target);",
+		`<div hidden id="slot-chunk-parent">`,
+		`<script>goviewSwap("parent")</script>`,
+		`<div hidden id="slot-chunk-nested">`,
+		`<script>goviewSwap("nested")</script>`,
+	)
+	if !strings.Contains(body, `<script>goviewSwap("late")</script>`) {
+		t.Errorf("the late chunk is not swapped in:\n%s", body)
+	}
+
+	// Live updates are processed once they replace a slot's contents.
+	w = httptest.NewRecorder()
+	New(htmxLayout).
+		Slot("clock", after(0, pinger("clock")), WithUpdates(Every(time.Second))).
+		ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	checkOrder(t, w.Body.String(),
+		"function goviewProcess(el)",
+		"new EventSource(location.href)",
+		".innerHTML = ",
+		"goviewProcess(el);",
+	)
+}
+
+func TestHTMXInStreamedSlots(t *testing.T) {
+	chrome := findChrome(t)
+
+	for _, m := range []Mode{Shadow, Script} {
+		t.Run(m.String(), func(t *testing.T) {
+			p := &pings{seen: make(map[string]bool), hit: make(chan struct{}, 1)}
+			want := []string{"late", "parent", "nested"}
+
+			// gate holds the document open until every ping has arrived, so
+			// they can only come from htmx processing slots as they stream in,
+			// not from htmx processing the page once it has loaded.
+			released := make(chan bool, 1)
+			s := New(htmxLayout, WithMode(m)).
+				Slot("late", after(50*time.Millisecond, pinger("late"))).
+				Slot("parent", func(ctx context.Context) (templ.Component, error) {
+					nested := Nest(ctx, "nested", after(50*time.Millisecond, pinger("nested")))
+					return templ.Join(pinger("parent"), nested), nil
+				}).
+				Slot("gate", func(ctx context.Context) (templ.Component, error) {
+					ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+					defer cancel()
+					released <- p.await(ctx, want...)
+					return templ.Raw("<p>Released</p>"), nil
+				})
+
+			mux := http.NewServeMux()
+			mux.Handle("/assets/", http.StripPrefix("/assets/", http.FileServer(http.Dir("../assets"))))
+			mux.Handle("/ping", p)
+			mux.Handle("/", s)
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			out, err := exec.CommandContext(ctx, chrome, "--headless=new", "--no-sandbox", "--disable-gpu", "--dump-dom", srv.URL).CombinedOutput()
+			if err != nil {
+				t.Fatalf("running %s: %v\n%s", chrome, err, out)
+			}
+
+			select {
+			case ok := <-released:
+				if !ok {
+					p.mu.Lock()
+					t.Errorf("htmx did not process every slot while streaming, want pings from %q, got %v", want, p.seen)
+					p.mu.Unlock()
+				}
+			default:
+				t.Fatalf("the page was never streamed:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestStreamedTitle(t *testing.T) {
+	chrome := findChrome(t)
+
+	for _, m := range []Mode{Shadow, Script, Buffered} {
+		t.Run(m.String(), func(t *testing.T) {
+			s := New(htmxLayout, WithMode(m)).
+				// The nested slot renders a's contents into a shadow root.
+				Slot("a", func(ctx context.Context) (templ.Component, error) {
+					nested := Nest(ctx, "nested", after(50*time.Millisecond, templates.A()))
+					return templ.Join(templates.Title(`Loaded "A" & more`), nested), nil
+				})
+			mux := http.NewServeMux()
+			mux.Handle("/assets/", http.StripPrefix("/assets/", http.FileServer(http.Dir("../assets"))))
+			mux.Handle("/", s)
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			out, err := exec.CommandContext(ctx, chrome, "--headless=new", "--no-sandbox", "--disable-gpu", "--dump-dom", srv.URL).CombinedOutput()
+			if err != nil {
+				t.Fatalf("running %s: %v\n%s", chrome, err, out)
+			}
+			if want := "<title>Loaded \"A\" &amp; more</title>"; !strings.Contains(string(out), want) {
+				t.Errorf("the slot did not update the title, want %s in:\n%s", want, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/a-h/templ"
+	"github.com/zackarysantana/goview/templates"
+)
+
+// Key declares a slot once, as a typed value that its registration, its
+// placeholder and the slots that depend on it all reference, so that a
+// misspelt name is a compile error. T is the type of the value the slot's
+// producer publishes; use struct{} if it publishes none.
+type Key[T any] struct {
+	name string
+}
+
+// NewKey declares the slot called name.
+func NewKey[T any](name string) Key[T] {
+	return Key[T]{name: name}
+}
+
+// Name returns the slot's name.
+func (k Key[T]) Name() string {
+	return k.name
+}
+
+func (k Key[T]) key() {}
+
+// AnyKey is a Key, whatever the type of its value.
+type AnyKey interface {
+	Name() string
+	key()
+}
+
+// SlotFor registers the slot declared by k, as Stream.Slot does.
+func SlotFor[T any](s *Stream, k Key[T], p Producer, opts ...SlotOption) *Stream {
+	return s.Slot(k.name, p, opts...)
+}
+
+// ListFor registers the list slot declared by k, as Stream.List does.
+func ListFor[T any](s *Stream, k Key[T], rows Rows, opts ...SlotOption) *Stream {
+	return s.List(k.name, rows, opts...)
+}
+
+// DependsOn makes the slot wait for the slots declared by keys, as
+// WithDependencies does.
+func DependsOn(keys ...AnyKey) SlotOption {
+	return func(sl *slot) {
+		for _, k := range keys {
+			sl.dependencies = append(sl.dependencies, k.Name())
+		}
+	}
+}
+
+// WithSubSlots declares the sub-slots that the slot's producer nests, so that
+// Validate knows about them. It does not nest them.
+func WithSubSlots(keys ...AnyKey) SlotOption {
+	return func(sl *slot) {
+		for _, k := range keys {
+			sl.subSlots = append(sl.subSlots, k.Name())
+		}
+	}
+}
+
+// Set publishes v as the slot's value. ctx must be the one passed to the slot's
+// producer.
+func (k Key[T]) Set(ctx context.Context, v T) {
+	SetValue(ctx, v)
+}
+
+// Value returns the value published by the slot, as Value does.
+func (k Key[T]) Value(ctx context.Context) (T, bool) {
+	return Value[T](ctx, k.name)
+}
+
+// Nest nests the slot under the slot being produced, as Nest does, and returns
+// its placeholder.
+func (k Key[T]) Nest(ctx context.Context, p Producer, opts ...SlotOption) templ.Component {
+	return Nest(ctx, k.name, p, opts...)
+}
+
+// placements counts the placeholders rendered for each slot.
+type placements struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (p *placements) add(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.counts[name]++
+}
+
+// Check renders r through the stream, running every producer, and reports
+// every slot that would be left loading or go missing: slots streamed without
+// a placeholder, placeholders that are never filled, names used more than
+// once or reserved, and dependencies on slots that are never streamed. It is meant for
+// tests; Validate checks the registrations at startup without doing the work.
+//
+// A dependency on a missing slot waits for its timeout, the stream's budget or
+// r's context, so bound at least one of them.
+func (s *Stream) Check(r *http.Request) error {
+	ctx, cancel := context.WithCancel(context.WithValue(r.Context(), requestKey{}, r))
+	run := newRun(ctx, s)
+	run.start()
+	defer run.drain()
+	defer cancel()
+
+	streamed := make(map[string]int)
+	resolved := make(map[string]templates.SlotContents)
+	resolve(run.root.data, resolved, streamed)
+
+	placed := &placements{counts: make(map[string]int)}
+	body := withRender(templates.Inline(s.placeholders(), templ.NopComponent), renderState{mode: Buffered, resolved: resolved, placed: placed})
+	if err := s.layout.Wrap(body).Render(ctx, io.Discard); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, name := range sortedKeys(streamed) {
+		if n := streamed[name]; n > 1 {
+			errs = append(errs, fmt.Errorf("stream: slot %q is streamed %d times", name, n))
+		}
+		if slices.Contains(reserved, name) {
+			errs = append(errs, errReserved(name))
+		}
+		switch n := placed.counts[name]; {
+		case n == 0:
+			errs = append(errs, fmt.Errorf("stream: slot %q is streamed but its placeholder is never rendered", name))
+		case n > 1:
+			errs = append(errs, fmt.Errorf("stream: slot %q has %d placeholders", name, n))
+		}
+	}
+	for _, name := range sortedKeys(placed.counts) {
+		if streamed[name] == 0 {
+			errs = append(errs, fmt.Errorf("stream: placeholder %q is never filled", name))
+		}
+	}
+	run.mu.Lock()
+	declared := slices.Clone(run.declared)
+	run.mu.Unlock()
+	for _, sl := range declared {
+		for _, dep := range sl.dependencies {
+			if streamed[dep] == 0 {
+				errs = append(errs, fmt.Errorf("stream: slot %q depends on %q, which is never streamed", sl.name, dep))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reserved are the names of the slots that the error summary and the waterfall
+// are assigned to, which a page's own slots cannot use.
+var reserved = []string{templates.ErrorsSlot, templates.DebugSlot}
+
+func errReserved(name string) error {
+	return fmt.Errorf("stream: slot %q uses a name reserved for the error summary and waterfall", name)
+}
+
+// Validate checks how the stream's slots are wired, from their registrations
+// alone, and reports names registered more than once or reserved for the error
+// summary and waterfall, dependencies on slots that are neither registered nor
+// declared with WithSubSlots, and dependency cycles. Unlike Check, it runs no producer, so it is cheap enough for startup.
+func (s *Stream) Validate() error {
+	var errs []error
+	known := make(map[string]int)
+	deps := make(map[string][]string)
+	for _, sl := range s.slots {
+		known[sl.name]++
+		deps[sl.name] = append(deps[sl.name], sl.dependencies...)
+		for _, sub := range sl.subSlots {
+			known[sub]++
+		}
+	}
+	for _, name := range sortedKeys(known) {
+		if n := known[name]; n > 1 {
+			errs = append(errs, fmt.Errorf("stream: slot %q is declared %d times", name, n))
+		}
+		if slices.Contains(reserved, name) {
+			errs = append(errs, errReserved(name))
+		}
+	}
+	for _, sl := range s.slots {
+		for _, dep := range sl.dependencies {
+			if known[dep] == 0 {
+				errs = append(errs, fmt.Errorf("stream: slot %q depends on %q, which is never declared", sl.name, dep))
+			}
+		}
+	}
+
+	// A depth-first search finds each cycle from the first slot registered in it.
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var path []string
+	var visit func(name string)
+	visit = func(name string) {
+		switch state[name] {
+		case visiting:
+			cycle := append(slices.Clone(path[slices.Index(path, name):]), name)
+			errs = append(errs, fmt.Errorf("stream: slots depend on each other in a cycle: %s", strings.Join(cycle, " -> ")))
+			return
+		case visited:
+			return
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range deps[name] {
+			visit(dep)
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+	}
+	for _, sl := range s.slots {
+		visit(sl.name)
+	}
+	return errors.Join(errs...)
+}
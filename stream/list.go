@@ -0,0 +1,230 @@
+package stream
+
+import (
+	"context"
+	"iter"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/zackarysantana/goview/templates"
+)
+
+// Rows produces the items of a list slot one at a time. It stops early with an
+// error if an item cannot be produced, and must stop once ctx is done.
+type Rows func(ctx context.Context) iter.Seq2[templ.Component, error]
+
+// Channel adapts a function that sends a list's items on a channel, and closes
+// it once they have all been sent, to Rows. It must stop sending once ctx is
+// done.
+func Channel(f func(ctx context.Context) <-chan templ.Component) Rows {
+	return func(ctx context.Context) iter.Seq2[templ.Component, error] {
+		return func(yield func(templ.Component, error) bool) {
+			for c := range f(ctx) {
+				if !yield(c, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// WithLimit renders at most n items of a list slot, followed by a terminator if
+// there were more. The list stops producing items once it has seen one past
+// the limit.
+func WithLimit(n int) SlotOption {
+	return func(sl *slot) {
+		sl.limit = n
+	}
+}
+
+// WithCount keeps producing the items past a list slot's limit, without
+// rendering them, to count them for its terminator.
+func WithCount() SlotOption {
+	return func(sl *slot) {
+		sl.count = true
+	}
+}
+
+// WithMore sets the terminator rendered after a list slot's limit, given how
+// many items were left out if they were counted with WithCount, or 0 if not.
+// It defaults to templates.More.
+func WithMore(more func(n int) templ.Component) SlotOption {
+	return func(sl *slot) {
+		sl.more = more
+	}
+}
+
+// List registers a named slot whose items are flushed into it one at a time,
+// each appended to the ones before it, as rows produces them. A failure or
+// timeout part of the way through appends the error component or the fallback
+// after the items already flushed.
+//
+// Lists are never cached, coalesced or retried, and their items cannot nest
+// sub-slots. Outside of the page's stream, such as in partials and live
+// updates, the items are rendered at once.
+func (s *Stream) List(name string, rows Rows, opts ...SlotOption) *Stream {
+	sl := newSlot(name, nil, opts)
+	sl.rows = rows
+	sl.cache, sl.group, sl.retry = nil, nil, nil
+	if sl.more == nil {
+		sl.more = templates.More
+	}
+	sl.produce = sl.collect
+	s.slots = append(s.slots, sl)
+	return s
+}
+
+// collect renders every item of a list slot at once.
+func (sl slot) collect(ctx context.Context) (templ.Component, error) {
+	var items []templ.Component
+	more, cut := 0, false
+	for c, err := range sl.rows(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		if sl.limit > 0 && len(items) >= sl.limit {
+			cut = true
+			if !sl.count {
+				break
+			}
+			more++
+			continue
+		}
+		items = append(items, c)
+	}
+	if cut {
+		items = append(items, sl.more(more))
+	}
+	return templ.Join(items...), nil
+}
+
+// row is an item of a list slot, or the error that ended it.
+type row struct {
+	contents templ.Component
+	err      error
+}
+
+// rows runs the list slot sl once its dependencies have resolved and the
+// scheduler has given it a turn, sending its items to the returned channel.
+func (r *run) rows(ctx context.Context, sl slot) <-chan row {
+	ch := make(chan row)
+	r.spawn(func() {
+		defer r.producing(sl.name)()
+		defer close(ch)
+		send := func(rw row) bool {
+			select {
+			case ch <- rw:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if err := r.awaitDependencies(ctx, sl); err != nil {
+			send(row{err: err})
+			return
+		}
+		if sched := r.stream.scheduler; sched != nil {
+			release, err := sched.acquire(ctx, r.stream.schedulerRoute)
+			if err != nil {
+				send(row{err: err})
+				return
+			}
+			defer release()
+		}
+		_, err := protect(slotCall(sl.name), func() (struct{}, error) {
+			produced := 0
+			for c, err := range sl.rows(ctx) {
+				if !send(row{contents: c, err: err}) || err != nil {
+					break
+				}
+				// One item past the limit is enough to know the list was cut.
+				if produced++; sl.limit > 0 && !sl.count && produced > sl.limit {
+					break
+				}
+			}
+			return struct{}{}, nil
+		})
+		if err != nil {
+			send(row{err: err})
+		}
+	})
+	return ch
+}
+
+// list streams the items of sl into n as they are produced, once it is the
+// slot's turn. The first item replaces the placeholder and the rest are
+// appended to it.
+func (r *run) list(n *node, sl slot, e *entry, t *timing, prev <-chan struct{}) {
+	ctx, _ := r.detached(n.ctx, e)
+	var cancel context.CancelFunc
+	if sl.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, sl.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	sent := 0
+	turn := false
+	emit := func(c templ.Component) bool {
+		if !turn {
+			r.awaitTurn(n, sl, prev)
+			turn = true
+		}
+		if !r.send(n.data, templates.SlotContents{Name: sl.name, Contents: c, Append: sent > 0}) {
+			return false
+		}
+		sent++
+		r.mark(&t.flushed)
+		return true
+	}
+
+	rows := r.rows(ctx, sl)
+	more, cut := 0, false
+	var err error
+loop:
+	for {
+		select {
+		case rw, ok := <-rows:
+			if !ok {
+				break loop
+			}
+			if rw.err != nil {
+				err = rw.err
+				break loop
+			}
+			if sl.limit > 0 && sent >= sl.limit {
+				cut = true
+				if !sl.count {
+					// Stop producing the items past the limit.
+					cancel()
+					break loop
+				}
+				more++
+				continue
+			}
+			if !emit(rw.contents) {
+				err = r.ctx.Err()
+				break loop
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+			break loop
+		}
+	}
+	r.mark(&t.finished)
+	if err != nil {
+		emit(r.fail(ctx, sl, e, err).Contents)
+		return
+	}
+
+	e.finish(true)
+	switch {
+	case cut:
+		emit(sl.more(more))
+	case sent == 0:
+		// Clear the placeholder of an empty list.
+		emit(templ.NopComponent)
+	}
+	r.metrics.slotSent(r.stream.metricsRoute, sl.name, time.Since(r.started))
+}
@@ -0,0 +1,183 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/a-h/templ"
+)
+
+// errNestedLive is returned by an update of a live slot whose producer nested
+// sub-slots, which have nowhere to stream to.
+var errNestedLive = errors.New("stream: a live slot update cannot nest sub-slots")
+
+// Watch returns a channel that receives whenever a live slot should be rendered
+// again. Closing the channel stops the slot's updates. The channel is abandoned
+// once ctx is done.
+type Watch func(ctx context.Context) <-chan struct{}
+
+// Every is a Watch that renders a live slot again every d.
+func Every(d time.Duration) Watch {
+	return func(ctx context.Context) <-chan struct{} {
+		ch := make(chan struct{})
+		go func() {
+			defer close(ch)
+			t := time.NewTicker(d)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+				case <-ctx.Done():
+					return
+				}
+				select {
+				case ch <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return ch
+	}
+}
+
+// WithUpdates keeps the slot live once the page has loaded. The page opens a
+// Server-Sent Events connection to its own URL and, whenever watch fires, the
+// slot's producer runs again and its new render replaces the slot's contents.
+// Only slots registered with Stream.Slot can be live.
+//
+// Updates bypass the slot's cache, dependencies and coalescing, and cannot
+// nest sub-slots.
+func WithUpdates(watch Watch) SlotOption {
+	return func(sl *slot) {
+		sl.watch = watch
+	}
+}
+
+// live reports whether any of the stream's slots is live.
+func (s *Stream) live() bool {
+	for _, sl := range s.slots {
+		if sl.watch != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// isEventStream reports whether r is a Server-Sent Events connection.
+func isEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// serveEvents sends a new render of a live slot whenever its Watch fires, until
+// the client disconnects.
+func (s *Stream) serveEvents(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithCancel(context.WithValue(r.Context(), requestKey{}, r))
+	defer cancel()
+	run := &run{stream: s, ctx: ctx, started: time.Now()}
+	defer run.wg.Wait()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	rc := http.NewResponseController(w)
+	var mu sync.Mutex
+	send := func(name string, contents templ.Component) error {
+		var buf bytes.Buffer
+		if err := contents.Render(ctx, &buf); err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err := writeEvent(w, name, buf.String()); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	mu.Lock()
+	_, err := io.WriteString(w, ": connected\n\n")
+	if err == nil {
+		err = rc.Flush()
+	}
+	mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	for _, sl := range s.slots {
+		if sl.watch == nil {
+			continue
+		}
+		run.spawn(func() {
+			updates, err := protect(slotCall(sl.name), func() (<-chan struct{}, error) {
+				return sl.watch(ctx), nil
+			})
+			if err != nil {
+				return
+			}
+			for {
+				select {
+				case _, ok := <-updates:
+					if !ok {
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+				if err := send(sl.name, run.update(ctx, sl)); err != nil {
+					log.Printf("stream: sending an update of slot %q failed: %v", sl.name, err)
+					cancel()
+					return
+				}
+			}
+		})
+	}
+	<-ctx.Done()
+}
+
+// update runs sl's producer again for a live update. As on the first render, a
+// failure renders the stream's error component and a timeout the fallback.
+func (r *run) update(ctx context.Context, sl slot) templ.Component {
+	// Loads of its own stop the update reading the values memoized by the
+	// previous one.
+	ctx, nested := r.detached(withLoads(ctx, r.spawn), newEntry())
+	if sl.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sl.timeout)
+		defer cancel()
+	}
+	res := r.invoke(ctx, sl)
+	if nested() && res.err == nil {
+		res.err = errNestedLive
+	}
+
+	switch {
+	case res.err != nil && ctx.Err() != nil:
+		return sl.fallback
+	case res.err != nil:
+		log.Printf("stream: updating slot %q failed: %v", sl.name, res.err)
+		return r.stream.errorComponent(sl.name, res.err)
+	}
+	return res.contents
+}
+
+// writeEvent writes html as a Server-Sent Event whose first data line is the
+// name of the slot it fills.
+func writeEvent(w io.Writer, name, html string) error {
+	var b strings.Builder
+	b.WriteString("data: " + name + "\n")
+	html = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(html)
+	for _, line := range strings.Split(html, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,236 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by Loader.Load for a key that its batch left out.
+var ErrNotFound = errors.New("stream: not found")
+
+// BatchFunc loads the values of keys at once. Keys without a value can be left
+// out of the map.
+type BatchFunc[K comparable, V any] func(ctx context.Context, keys []K) (map[K]V, error)
+
+// Loader lets the producers of a page share the data they load. The keys they
+// ask for within wait of each other are loaded in one batch, and each value is
+// memoized for the rest of the request, so a key is only loaded once however
+// many slots need it. Failed loads are not memoized.
+//
+// Each request, partial, live update, shared run and refresh has loads of its
+// own, and a Loader can be shared by every stream. Outside of them, each key is
+// loaded on its own. It is safe for concurrent use.
+type Loader[K comparable, V any] struct {
+	batch BatchFunc[K, V]
+	wait  time.Duration
+}
+
+// NewLoader creates a Loader that collects keys for wait before loading them
+// with batch.
+func NewLoader[K comparable, V any](wait time.Duration, batch BatchFunc[K, V]) *Loader[K, V] {
+	return &Loader[K, V]{batch: batch, wait: wait}
+}
+
+type loadsKey struct{}
+
+// loads holds the state of every Loader used by a request.
+type loads struct {
+	// spawn runs a batch in a goroutine that the request waits for. It is nil
+	// for work that may outlive the request, whose batches run on their own.
+	spawn func(f func())
+
+	mu      sync.Mutex
+	loaders map[any]any
+}
+
+// withLoads returns a copy of ctx with loads of its own, whose batches are run
+// by spawn.
+func withLoads(ctx context.Context, spawn func(f func())) context.Context {
+	return context.WithValue(ctx, loadsKey{}, &loads{spawn: spawn, loaders: make(map[any]any)})
+}
+
+// loaderState is a Loader's state in one request.
+type loaderState[K comparable, V any] struct {
+	spawn func(f func())
+
+	mu    sync.Mutex
+	loads map[K]*load[K, V]
+	// next is the batch still collecting keys, if any.
+	next *batch[K, V]
+}
+
+// load is a key's value, once done is closed.
+type load[K comparable, V any] struct {
+	done  chan struct{}
+	b     *batch[K, V]
+	value V
+	err   error
+}
+
+// batch is a set of keys loaded together.
+type batch[K comparable, V any] struct {
+	keys    []K
+	loads   []*load[K, V]
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// state returns l's state in the request of ctx, or nil outside of one.
+func (l *Loader[K, V]) state(ctx context.Context) *loaderState[K, V] {
+	ls, ok := ctx.Value(loadsKey{}).(*loads)
+	if !ok {
+		return nil
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	st, ok := ls.loaders[l].(*loaderState[K, V])
+	if !ok {
+		st = &loaderState[K, V]{spawn: ls.spawn, loads: make(map[K]*load[K, V])}
+		ls.loaders[l] = st
+	}
+	return st
+}
+
+// Load returns the value of key, waiting for the batch it is loaded in. The
+// batch runs detached from ctx, and is cancelled once every caller waiting
+// for it has stopped.
+func (l *Loader[K, V]) Load(ctx context.Context, key K) (V, error) {
+	st := l.state(ctx)
+	if st == nil {
+		return l.fetch(ctx, key)
+	}
+
+	st.mu.Lock()
+	ld, ok := st.loads[key]
+	if !ok {
+		if st.next == nil {
+			bctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+			b := &batch[K, V]{cancel: cancel}
+			st.next = b
+			st.start(func() { l.collect(bctx, st, b) })
+		}
+		ld = &load[K, V]{done: make(chan struct{}), b: st.next}
+		ld.b.keys = append(ld.b.keys, key)
+		ld.b.loads = append(ld.b.loads, ld)
+		st.loads[key] = ld
+	}
+	select {
+	case <-ld.done:
+		st.mu.Unlock()
+		return ld.value, ld.err
+	default:
+	}
+	ld.b.waiters++
+	st.mu.Unlock()
+
+	select {
+	case <-ld.done:
+		return ld.value, ld.err
+	case <-ctx.Done():
+		st.mu.Lock()
+		b := ld.b
+		b.waiters--
+		if b.waiters == 0 {
+			// Later callers start afresh rather than join a cancelled batch.
+			st.forget(b)
+			b.cancel()
+		}
+		st.mu.Unlock()
+		var zero V
+		return zero, ctx.Err()
+	}
+}
+
+// forget removes the keys of b from the loads, unless they have been replaced,
+// and stops b collecting more. st.mu must be held.
+func (st *loaderState[K, V]) forget(b *batch[K, V]) {
+	if st.next == b {
+		st.next = nil
+	}
+	for i, key := range b.keys {
+		if st.loads[key] == b.loads[i] {
+			delete(st.loads, key)
+		}
+	}
+}
+
+// start runs f in the request's goroutines, or on its own outside of them.
+func (st *loaderState[K, V]) start(f func()) {
+	if st.spawn == nil {
+		go f()
+		return
+	}
+	st.spawn(f)
+}
+
+// collect waits for the keys of b to be collected, then loads them. It stops
+// waiting early if b is cancelled.
+func (l *Loader[K, V]) collect(ctx context.Context, st *loaderState[K, V], b *batch[K, V]) {
+	t := time.NewTimer(l.wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	l.run(ctx, st, b)
+}
+
+// run loads the keys of b once it has stopped collecting them.
+func (l *Loader[K, V]) run(ctx context.Context, st *loaderState[K, V], b *batch[K, V]) {
+	defer b.cancel()
+	st.mu.Lock()
+	if st.next == b {
+		st.next = nil
+	}
+	keys := b.keys
+	st.mu.Unlock()
+
+	var values map[K]V
+	err := ctx.Err()
+	if err == nil {
+		values, err = l.call(ctx, keys)
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for i, key := range keys {
+		ld := b.loads[i]
+		ld.value, ld.err = lookup(values, err, key)
+		close(ld.done)
+	}
+	for i, key := range keys {
+		if b.loads[i].err != nil && st.loads[key] == b.loads[i] {
+			// Later loads of the key try again.
+			delete(st.loads, key)
+		}
+	}
+}
+
+// fetch loads key on its own.
+func (l *Loader[K, V]) fetch(ctx context.Context, key K) (V, error) {
+	values, err := l.call(ctx, []K{key})
+	return lookup(values, err, key)
+}
+
+// call calls the loader's BatchFunc, recovering a panic as a *PanicError.
+func (l *Loader[K, V]) call(ctx context.Context, keys []K) (map[K]V, error) {
+	return protect(fmt.Sprintf("loading %v", keys), func() (map[K]V, error) {
+		return l.batch(ctx, keys)
+	})
+}
+
+// lookup returns the value of key from the result of a batch.
+func lookup[K comparable, V any](values map[K]V, err error, key K) (V, error) {
+	v, ok := values[key]
+	switch {
+	case err != nil:
+		var zero V
+		return zero, err
+	case !ok:
+		return v, fmt.Errorf("%w: %v", ErrNotFound, key)
+	}
+	return v, nil
+}
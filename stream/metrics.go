@@ -0,0 +1,275 @@
+package stream
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buckets are the upper bounds, in seconds, of every latency histogram.
+var buckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics records the latency and outcome of streamed requests and exposes
+// them in the Prometheus text format. A nil *Metrics records nothing.
+type Metrics struct {
+	mu         sync.Mutex
+	ttfb       map[string]*histogram
+	slots      map[slotLabels]*histogram
+	errors     map[slotLabels]uint64
+	timeouts   map[slotLabels]uint64
+	inFlight   map[string]int
+	schedulers []*Scheduler
+}
+
+type slotLabels struct {
+	route string
+	slot  string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets))
+	}
+	s := d.Seconds()
+	for i, b := range buckets {
+		if s <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += s
+	h.count++
+}
+
+// NewMetrics creates an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		ttfb:     make(map[string]*histogram),
+		slots:    make(map[slotLabels]*histogram),
+		errors:   make(map[slotLabels]uint64),
+		timeouts: make(map[slotLabels]uint64),
+		inFlight: make(map[string]int),
+	}
+}
+
+// WithMetrics records the stream's requests in m under route.
+func WithMetrics(m *Metrics, route string) Option {
+	return func(s *Stream) {
+		s.metrics = m
+		s.metricsRoute = route
+	}
+}
+
+// WatchScheduler exposes the queue depth and activity of sched.
+func (m *Metrics) WatchScheduler(sched *Scheduler) *Metrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.schedulers = append(m.schedulers, sched)
+	return m
+}
+
+func (m *Metrics) startStream(route string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight[route]++
+}
+
+func (m *Metrics) endStream(route string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight[route]--
+}
+
+func (m *Metrics) firstByte(route string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.ttfb[route]
+	if !ok {
+		h = &histogram{}
+		m.ttfb[route] = h
+	}
+	h.observe(d)
+}
+
+func (m *Metrics) slotSent(route, slot string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := slotLabels{route: route, slot: slot}
+	h, ok := m.slots[l]
+	if !ok {
+		h = &histogram{}
+		m.slots[l] = h
+	}
+	h.observe(d)
+}
+
+func (m *Metrics) slotFailed(route, slot string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[slotLabels{route: route, slot: slot}]++
+}
+
+func (m *Metrics) slotTimedOut(route, slot string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.timeouts[slotLabels{route: route, slot: slot}]++
+}
+
+// ServeHTTP writes every metric in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes every metric to w in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	header(&b, "goview_time_to_first_byte_seconds", "histogram", "Time from the start of a streamed request until its first byte was written.")
+	for _, route := range sortedKeys(m.ttfb) {
+		writeHistogram(&b, "goview_time_to_first_byte_seconds", labels("route", route), m.ttfb[route])
+	}
+
+	header(&b, "goview_slot_duration_seconds", "histogram", "Time from the start of a streamed request until a slot's result was sent to the client.")
+	for _, l := range sortedSlots(m.slots) {
+		writeHistogram(&b, "goview_slot_duration_seconds", labels("route", l.route, "slot", l.slot), m.slots[l])
+	}
+
+	header(&b, "goview_slot_errors_total", "counter", "Slot producers that returned an error.")
+	for _, l := range sortedSlots(m.errors) {
+		fmt.Fprintf(&b, "goview_slot_errors_total{%s} %d\n", labels("route", l.route, "slot", l.slot), m.errors[l])
+	}
+
+	header(&b, "goview_slot_timeouts_total", "counter", "Slots that ran out of time and rendered their fallback.")
+	for _, l := range sortedSlots(m.timeouts) {
+		fmt.Fprintf(&b, "goview_slot_timeouts_total{%s} %d\n", labels("route", l.route, "slot", l.slot), m.timeouts[l])
+	}
+
+	header(&b, "goview_streams_in_flight", "gauge", "Streamed requests currently being served.")
+	for _, route := range sortedKeys(m.inFlight) {
+		fmt.Fprintf(&b, "goview_streams_in_flight{%s} %d\n", labels("route", route), m.inFlight[route])
+	}
+
+	if len(m.schedulers) > 0 {
+		var stats SchedulerStats
+		for _, sched := range m.schedulers {
+			s := sched.Stats()
+			stats.Queued += s.Queued
+			stats.Running += s.Running
+			stats.Started += s.Started
+			stats.QueueTime += s.QueueTime
+		}
+		header(&b, "goview_producers_queued", "gauge", "Slot producers waiting for the scheduler.")
+		fmt.Fprintf(&b, "goview_producers_queued %d\n", stats.Queued)
+		header(&b, "goview_producers_running", "gauge", "Slot producers currently running on the scheduler.")
+		fmt.Fprintf(&b, "goview_producers_running %d\n", stats.Running)
+		header(&b, "goview_producers_started_total", "counter", "Slot producers started by the scheduler.")
+		fmt.Fprintf(&b, "goview_producers_started_total %d\n", stats.Started)
+		header(&b, "goview_producer_queue_seconds_total", "counter", "Total time started slot producers spent queued.")
+		fmt.Fprintf(&b, "goview_producer_queue_seconds_total %g\n", stats.QueueTime.Seconds())
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func header(b *strings.Builder, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeHistogram(b *strings.Builder, name, labels string, h *histogram) {
+	for i, le := range buckets {
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, le, h.counts[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(b, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(b, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// labels formats alternating label names and values.
+func labels(kv ...string) string {
+	var b strings.Builder
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", kv[i], r.Replace(kv[i+1]))
+	}
+	return b.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func sortedSlots[V any](m map[slotLabels]V) []slotLabels {
+	keys := make([]slotLabels, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b slotLabels) int {
+		return strings.Compare(a.route+"\x00"+a.slot, b.route+"\x00"+b.slot)
+	})
+	return keys
+}
+
+// firstByteWriter reports when the first byte of a response is written.
+type firstByteWriter struct {
+	http.ResponseWriter
+	once func()
+}
+
+func (w *firstByteWriter) Write(p []byte) (int, error) {
+	if w.once != nil {
+		w.once()
+		w.once = nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher.
+func (w *firstByteWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying http.ResponseWriter for http.ResponseController.
+func (w *firstByteWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,188 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/a-h/templ"
+	"github.com/zackarysantana/goview/templates"
+)
+
+// Mode controls how slot results are delivered to the client.
+type Mode int
+
+const (
+	// Shadow streams each result as soon as it is ready and projects it into its
+	// placeholder through a declarative shadow root.
+	//
+	// A slot's sub-slots must be streamed inside the element that hosts its
+	// contents, so the slot is not closed until every sub-slot nested in it has
+	// arrived, and the slots that finish in the meantime are held back behind
+	// it. Pages whose sub-slots take long should use Script instead.
+	Shadow Mode = iota
+	// Buffered waits for every slot and inlines each result where its
+	// placeholder sits, producing one complete, ordinary HTML document for
+	// crawlers, tests and clients that do not handle streaming.
+	Buffered
+	// Script streams each result as a hidden chunk in the light DOM, which a
+	// small inline script moves into its placeholder. It works in browsers
+	// without declarative shadow DOM, and the page's styles apply to the
+	// contents as usual. Sub-slots are streamed as chunks of their own, so
+	// no slot is held back behind another's.
+	Script
+)
+
+var modeNames = map[Mode]string{
+	Shadow:   "shadow",
+	Buffered: "buffered",
+	Script:   "script",
+}
+
+func (m Mode) String() string {
+	if name, ok := modeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("Mode(%d)", m)
+}
+
+// ParseMode returns the Mode with the given name.
+func ParseMode(name string) (Mode, error) {
+	for m, n := range modeNames {
+		if strings.EqualFold(n, name) {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("stream: unknown mode %q", name)
+}
+
+// ModeRule picks the mode for a request. It reports false if it does not apply.
+type ModeRule func(r *http.Request) (Mode, bool)
+
+// WithMode sets the mode used when no rule applies. It defaults to Shadow, which
+// holds slots back behind any sibling whose sub-slots are still streaming; see
+// Shadow.
+func WithMode(m Mode) Option {
+	return func(s *Stream) {
+		s.mode = m
+	}
+}
+
+// WithModeRules adds rules that pick the mode per request. The first rule that
+// applies wins.
+func WithModeRules(rules ...ModeRule) Option {
+	return func(s *Stream) {
+		s.modeRules = append(s.modeRules, rules...)
+	}
+}
+
+// QueryMode selects the mode named by the query parameter param, for example
+// ?render=buffered. Unknown names are ignored.
+func QueryMode(param string) ModeRule {
+	return func(r *http.Request) (Mode, bool) {
+		m, err := ParseMode(r.URL.Query().Get(param))
+		return m, err == nil
+	}
+}
+
+// UserAgentMode selects m for requests whose User-Agent contains any of substrs,
+// ignoring case.
+func UserAgentMode(m Mode, substrs ...string) ModeRule {
+	return func(r *http.Request) (Mode, bool) {
+		ua := strings.ToLower(r.UserAgent())
+		for _, s := range substrs {
+			if strings.Contains(ua, strings.ToLower(s)) {
+				return m, true
+			}
+		}
+		return 0, false
+	}
+}
+
+// AcceptMode selects m for requests whose Accept header does not explicitly
+// list text/html, such as curl's default of */*. Browsers always list it.
+func AcceptMode(m Mode) ModeRule {
+	return func(r *http.Request) (Mode, bool) {
+		for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+			if mt, _, err := mime.ParseMediaType(v); err == nil && mt == "text/html" {
+				return 0, false
+			}
+		}
+		return m, true
+	}
+}
+
+// modeFor picks the mode for r.
+func (s *Stream) modeFor(r *http.Request) Mode {
+	for _, rule := range s.modeRules {
+		if m, ok := rule(r); ok {
+			return m
+		}
+	}
+	return s.mode
+}
+
+type renderKey struct{}
+
+// renderState tells the placeholders of nested slots how the page is rendered.
+type renderState struct {
+	mode Mode
+	// resolved holds the contents of every slot in Buffered mode.
+	resolved map[string]templates.SlotContents
+	// placed, if set, counts the placeholders rendered, for Check.
+	placed *placements
+}
+
+// withRender renders body with the placeholders inside it rendered for state.
+func withRender(body templ.Component, state renderState) templ.Component {
+	return templ.ComponentFunc(func(ctx context.Context, w io.Writer) error {
+		return body.Render(context.WithValue(ctx, renderKey{}, state), w)
+	})
+}
+
+// placeholder renders the placeholder of sl for the page's mode or, once the
+// slot has been resolved in Buffered mode, its contents.
+func placeholder(sl slot) templ.Component {
+	name := sl.name
+	return templ.ComponentFunc(func(ctx context.Context, w io.Writer) error {
+		state, _ := ctx.Value(renderKey{}).(renderState)
+		if state.placed != nil {
+			state.placed.add(name)
+		}
+		switch state.mode {
+		case Buffered:
+			if sc, ok := state.resolved[name]; ok {
+				return templates.InlineSlot(sc).Render(ctx, w)
+			}
+			return nil
+		case Script:
+			return templates.SwapSlot(name, sl.placeholder).Render(ctx, w)
+		default:
+			return templates.ExampleSlot(name, sl.placeholder).Render(ctx, w)
+		}
+	})
+}
+
+// resolve waits for every slot sent to data, including nested ones, and
+// records its contents by name. The items of a list are joined together. If
+// streamed is not nil, it counts how many times each name is streamed, with
+// the items of a list counting once.
+func resolve(data <-chan templates.SlotContents, resolved map[string]templates.SlotContents, streamed map[string]int) {
+	for sc := range data {
+		if prev, ok := resolved[sc.Name]; ok && sc.Append {
+			prev.Contents = templ.Join(prev.Contents, sc.Contents)
+			resolved[sc.Name] = prev
+			continue
+		}
+		if streamed != nil {
+			streamed[sc.Name]++
+		}
+		resolved[sc.Name] = sc
+		if sc.Children != nil {
+			resolve(sc.Children, resolved, streamed)
+		}
+	}
+}
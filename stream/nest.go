@@ -0,0 +1,79 @@
+package stream
+
+import (
+	"context"
+	"sync"
+
+	"github.com/a-h/templ"
+	"github.com/zackarysantana/goview/templates"
+)
+
+// node collects the sub-slots of a slot, or the top-level slots of the page.
+type node struct {
+	// ctx bounds the producers of the node's children.
+	ctx    context.Context
+	cancel context.CancelFunc
+	data   chan templates.SlotContents
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	sealed bool
+	nested bool
+	// last is closed once the most recently nested child has been sent.
+	last chan struct{}
+}
+
+func newNode(ctx context.Context, cancel context.CancelFunc) *node {
+	last := make(chan struct{})
+	close(last)
+	return &node{
+		ctx:    ctx,
+		cancel: cancel,
+		data:   make(chan templates.SlotContents),
+		last:   last,
+	}
+}
+
+type scopeKey struct{}
+
+// scope is stored in the context passed to a producer, so that it can nest
+// sub-slots under its own slot and publish its value.
+type scope struct {
+	run   *run
+	node  *node
+	entry *entry
+}
+
+// detached returns a copy of ctx for a producer that runs apart from the
+// request's slots, such as a shared run, a refresh or a live update. It cannot
+// nest sub-slots, which would have nowhere to stream to, and publishes its
+// value to e. nested reports whether the producer tried to nest any.
+func (r *run) detached(ctx context.Context, e *entry) (_ context.Context, nested func() bool) {
+	children := &node{sealed: true}
+	ctx = context.WithValue(ctx, scopeKey{}, &scope{run: r, node: children, entry: e})
+	return ctx, func() bool {
+		children.mu.Lock()
+		defer children.mu.Unlock()
+		return children.nested
+	}
+}
+
+// Nest registers a sub-slot of the slot being produced, which must be the one
+// whose producer received ctx, and returns the placeholder to render where the
+// sub-slot's contents should appear. The sub-slot starts immediately and keeps
+// streaming after the parent has been flushed; the page is only complete once
+// every descendant has resolved. In Shadow mode, other slots that finish while
+// a subtree is still streaming are held back until it closes, which Script mode
+// avoids.
+//
+// Slot names must be unique across the whole page. Sub-slots nested after the
+// parent's producer has returned, timed out or failed are never started.
+func Nest(ctx context.Context, name string, p Producer, opts ...SlotOption) templ.Component {
+	sc, ok := ctx.Value(scopeKey{}).(*scope)
+	if !ok {
+		panic("stream: Nest called outside of a slot producer")
+	}
+	sl := newSlot(name, p, opts)
+	sc.run.nest(sc.node, sl)
+	return placeholder(sl)
+}
@@ -0,0 +1,183 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrDependency is returned for a slot whose dependency did not resolve.
+var ErrDependency = errors.New("stream: dependency did not resolve")
+
+// WithDocumentOrder holds each result back until the slots registered before it,
+// at the same level, have been flushed. Producers still run concurrently.
+func WithDocumentOrder() Option {
+	return func(s *Stream) {
+		s.ordered = true
+	}
+}
+
+// WithDependencies makes the slot wait for the named slots to resolve before
+// its producer starts, so that it can read their values with Value. It fails
+// with ErrDependency if any of them fails or times out. Unless the stream
+// flushes in document order, the slot is also flushed after any dependency
+// registered at the same level.
+//
+// Dependency cycles, or dependencies on slots that are never registered, wait
+// until the slot's timeout or the stream's budget runs out. Stream.Validate
+// reports both.
+func WithDependencies(names ...string) SlotOption {
+	return func(sl *slot) {
+		sl.dependencies = append(sl.dependencies, names...)
+	}
+}
+
+// entry tracks the progress of a slot that other slots may depend on.
+type entry struct {
+	// parent is the node the slot was nested under.
+	parent *node
+	// produced is closed once the slot has a result.
+	produced chan struct{}
+	// sent is closed once the result has been sent to the body, or the request
+	// is over.
+	sent chan struct{}
+
+	mu    sync.Mutex
+	value any
+	ok    bool
+}
+
+func newEntry() *entry {
+	return &entry{
+		produced: make(chan struct{}),
+		sent:     make(chan struct{}),
+	}
+}
+
+// lookup returns the entry of the named slot, creating it if the slot has not
+// been nested yet.
+func (r *run) lookup(name string) *entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.entries == nil {
+		r.entries = make(map[string]*entry)
+	}
+	e, ok := r.entries[name]
+	if !ok {
+		e = newEntry()
+		r.entries[name] = e
+	}
+	return e
+}
+
+// claim returns the entry of the named slot being nested under n. A duplicate
+// name gets an entry of its own that nothing can depend on.
+func (r *run) claim(name string, n *node) *entry {
+	e := r.lookup(name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e.parent != nil {
+		return newEntry()
+	}
+	e.parent = n
+	return e
+}
+
+// finish records whether the slot resolved successfully and releases the slots
+// that depend on it.
+func (e *entry) finish(ok bool) {
+	e.mu.Lock()
+	e.ok = ok
+	e.mu.Unlock()
+	close(e.produced)
+}
+
+func (e *entry) get() any {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.value
+}
+
+func (e *entry) set(v any) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.value = v
+}
+
+// awaitDependencies waits for every dependency of sl to resolve.
+func (r *run) awaitDependencies(ctx context.Context, sl slot) error {
+	for _, name := range sl.dependencies {
+		e := r.lookup(name)
+		select {
+		case <-e.produced:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		e.mu.Lock()
+		ok := e.ok
+		e.mu.Unlock()
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrDependency, name)
+		}
+	}
+	return nil
+}
+
+// awaitTurn waits until sl, nested under n after the sibling that closes prev,
+// may be sent to the body.
+func (r *run) awaitTurn(n *node, sl slot, prev <-chan struct{}) {
+	if r.stream.ordered {
+		r.wait(prev)
+		return
+	}
+	for _, name := range sl.dependencies {
+		e := r.lookup(name)
+		r.mu.Lock()
+		sibling := e.parent == n
+		r.mu.Unlock()
+		if sibling {
+			r.wait(e.sent)
+		}
+	}
+}
+
+// wait blocks until ch is closed or the request is over.
+func (r *run) wait(ch <-chan struct{}) {
+	select {
+	case <-ch:
+	case <-r.ctx.Done():
+	}
+}
+
+// SetValue publishes v as the value of the slot being produced, which must be
+// the one whose producer received ctx. Slots that depend on it can read it
+// with Value.
+func SetValue(ctx context.Context, v any) {
+	sc, ok := ctx.Value(scopeKey{}).(*scope)
+	if !ok {
+		panic("stream: SetValue called outside of a slot producer")
+	}
+	sc.entry.set(v)
+}
+
+// Value returns the value published by the named slot. It reports false if the
+// slot has not resolved successfully, or its value is not a T. Declare the slot
+// with WithDependencies to wait for it.
+func Value[T any](ctx context.Context, name string) (T, bool) {
+	var zero T
+	sc, ok := ctx.Value(scopeKey{}).(*scope)
+	if !ok {
+		return zero, false
+	}
+	e := sc.run.lookup(name)
+	select {
+	case <-e.produced:
+	default:
+		return zero, false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	v, ok := e.value.(T)
+	return v, ok && e.ok
+}
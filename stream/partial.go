@@ -0,0 +1,99 @@
+package stream
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/a-h/templ"
+	"github.com/zackarysantana/goview/templates"
+)
+
+// Partials returns a handler that renders a single slot registered with
+// Stream.Slot on its own, at prefix followed by the slot's name, so that htmx
+// can refresh one section of the page without reloading the rest:
+//
+//	http.Handle("/slot/", page.Partials("/slot/"))
+//
+// The slot's producer runs exactly as it does for the page, with the same
+// request parameters, cache and timeouts. Sub-slots it nests are rendered in
+// place, and the top-level slots it depends on run alongside it. A slot whose
+// producer fails is rendered with the stream's error component and a 500
+// status, which htmx does not swap in by default.
+func (s *Stream) Partials(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutPrefix(r.URL.Path, prefix)
+		if !ok || !s.has(name) {
+			http.NotFound(w, r)
+			return
+		}
+		w, done := s.compress(w, r)
+		defer done()
+		s.servePartial(w, r, name)
+	})
+}
+
+// has reports whether a slot called name is registered with Stream.Slot.
+func (s *Stream) has(name string) bool {
+	for _, sl := range s.slots {
+		if sl.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// servePartial renders the named slot once it and everything nested in it has
+// resolved.
+func (s *Stream) servePartial(w http.ResponseWriter, r *http.Request, name string) {
+	ctx, cancel := context.WithCancel(context.WithValue(r.Context(), requestKey{}, r))
+	run := newRun(ctx, s)
+	for _, sl := range s.partialSlots(name) {
+		run.nest(run.root, sl)
+	}
+	run.seal(run.root)
+	defer run.drain()
+	defer cancel()
+
+	resolved := make(map[string]templates.SlotContents)
+	resolve(run.root.data, resolved, nil)
+	sc, ok := resolved[name]
+	if !ok {
+		// The client went away before the slot was sent.
+		return
+	}
+	status := http.StatusOK
+	if sc.Err != nil {
+		status = http.StatusInternalServerError
+	}
+	body := withRender(sc.Contents, renderState{mode: Buffered, resolved: resolved})
+	templ.Handler(body, templ.WithStatus(status)).ServeHTTP(w, r)
+}
+
+// partialSlots returns the named slot and every top-level slot it depends on,
+// directly or not, in the order they were registered.
+func (s *Stream) partialSlots(name string) []slot {
+	need := map[string]bool{name: true}
+	for changed := true; changed; {
+		changed = false
+		for _, sl := range s.slots {
+			if !need[sl.name] {
+				continue
+			}
+			for _, dep := range sl.dependencies {
+				if !need[dep] {
+					need[dep] = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	var slots []slot
+	for _, sl := range s.slots {
+		if need[sl.name] {
+			slots = append(slots, sl)
+		}
+	}
+	return slots
+}
@@ -0,0 +1,103 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/cenkalti/backoff/v4"
+)
+
+// PanicError is the error of a slot whose producer panicked.
+type PanicError struct {
+	// Value is the value the producer panicked with.
+	Value any
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("stream: producer panicked: %v", e.Value)
+}
+
+// protect calls f, recovering a panic as a *PanicError and logging it with its
+// stack trace. what describes the call in the log, such as slotCall(name).
+func protect[T any](what string, f func() (T, error)) (v T, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			stack := debug.Stack()
+			log.Printf("stream: %s panicked: %v\n%s", what, p, stack)
+			err = &PanicError{Value: p, Stack: stack}
+		}
+	}()
+	return f()
+}
+
+// slotCall describes a call to the named slot's producer for protect.
+func slotCall(name string) string {
+	return fmt.Sprintf("slot %q", name)
+}
+
+// Retry creates the BackOff that paces the retries of a single run of a slot's
+// producer.
+type Retry func() backoff.BackOff
+
+// Exponential retries a producer until it has run attempts times in all,
+// waiting between attempts for a jittered interval that starts at initial and
+// grows exponentially.
+func Exponential(attempts int, initial time.Duration) Retry {
+	return func() backoff.BackOff {
+		b := backoff.NewExponentialBackOff()
+		b.InitialInterval = initial
+		b.MaxElapsedTime = 0
+		return backoff.WithMaxRetries(b, uint64(max(attempts-1, 0)))
+	}
+}
+
+// WithRetry runs the slot's producer again when it fails, waiting between
+// attempts as paced by retry, while its placeholder stays visible. Every
+// attempt shares the slot's timeout and the stream's budget. Panics, and errors
+// wrapped with backoff.Permanent, are not retried.
+func WithRetry(retry Retry) SlotOption {
+	return func(sl *slot) {
+		sl.retry = retry
+	}
+}
+
+// invoke runs sl's producer, retrying it if it has a retry policy.
+func (r *run) invoke(ctx context.Context, sl slot) result {
+	if sl.retry == nil {
+		return r.attempt(ctx, sl)
+	}
+	notify := func(err error, d time.Duration) {
+		log.Printf("stream: slot %q failed, retrying in %s: %v", sl.name, d.Round(time.Millisecond), err)
+	}
+	contents, err := backoff.RetryNotifyWithData(func() (templ.Component, error) {
+		res := r.attempt(ctx, sl)
+		var pe *PanicError
+		if res.err != nil && (errors.As(res.err, &pe) || ctx.Err() != nil) {
+			return nil, backoff.Permanent(res.err)
+		}
+		return res.contents, res.err
+	}, backoff.WithContext(sl.retry(), ctx), notify)
+	return result{contents: contents, err: err}
+}
+
+// attempt runs sl's producer once the scheduler has given it a turn.
+func (r *run) attempt(ctx context.Context, sl slot) result {
+	if sched := r.stream.scheduler; sched != nil {
+		release, err := sched.acquire(ctx, r.stream.schedulerRoute)
+		if err != nil {
+			return result{err: err}
+		}
+		defer release()
+	}
+	contents, err := protect(slotCall(sl.name), func() (templ.Component, error) {
+		return sl.produce(ctx)
+	})
+	return result{contents: contents, err: err}
+}
@@ -0,0 +1,354 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/zackarysantana/goview/templates"
+)
+
+// run holds the state of a single streamed request.
+type run struct {
+	stream *Stream
+	// metrics records the run's slots. Only pages are measured, so it is nil
+	// for partials and checks.
+	metrics *Metrics
+	// ctx is done once the request is over. Results are sent until then.
+	ctx     context.Context
+	started time.Time
+	root    *node
+	wg      sync.WaitGroup
+
+	mu        sync.Mutex
+	errs      []templates.SlotContents
+	entries   map[string]*entry
+	timings   []*timing
+	declared  []slot
+	firstByte time.Duration
+	// running counts the producers of each slot that have not returned yet.
+	running map[string]int
+}
+
+// newRun creates the run for a request whose lifetime is bounded by ctx.
+func newRun(ctx context.Context, s *Stream) *run {
+	r := &run{stream: s, started: time.Now()}
+	// The producers' loads are batched in the run's goroutines, so that none
+	// outlives the request.
+	ctx = withLoads(ctx, r.spawn)
+	// Producers are bounded by the budget, but results are still sent after it
+	// runs out so that unfilled slots receive their fallback.
+	var produceCtx context.Context
+	var cancel context.CancelFunc
+	if s.budget > 0 {
+		produceCtx, cancel = context.WithTimeout(ctx, s.budget)
+	} else {
+		produceCtx, cancel = context.WithCancel(ctx)
+	}
+	r.ctx = ctx
+	r.root = newNode(produceCtx, cancel)
+	return r
+}
+
+// start runs every top-level producer. The root's data is closed once every
+// slot has a result, or the budget has run out.
+func (r *run) start() {
+	for _, sl := range r.stream.slots {
+		r.nest(r.root, sl)
+	}
+	r.seal(r.root)
+}
+
+// spawn runs f in a goroutine that the request waits for before it returns.
+func (r *run) spawn(f func()) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		f()
+	}()
+}
+
+// budgetGrace is how long a request with a budget waits past it for producers
+// that ignore their context.
+const budgetGrace = 100 * time.Millisecond
+
+// drain waits for the run's goroutines before the request returns. With a
+// budget, it gives up a grace period after the budget has run out, so that a
+// producer that ignores its context cannot hold the response open, and logs
+// the slots whose producers are left running.
+func (r *run) drain() {
+	if r.stream.budget <= 0 {
+		r.wg.Wait()
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	t := time.NewTimer(time.Until(r.started.Add(r.stream.budget + budgetGrace)))
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C:
+		r.mu.Lock()
+		names := sortedKeys(r.running)
+		r.mu.Unlock()
+		log.Printf("stream: slots %q are still running after the budget; their producers should return once ctx is done", names)
+	}
+}
+
+// producing records that a producer of the named slot is running, until the
+// returned function is called.
+func (r *run) producing(name string) (stop func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running == nil {
+		r.running = make(map[string]int)
+	}
+	r.running[name]++
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.running[name]--; r.running[name] == 0 {
+			delete(r.running, name)
+		}
+	}
+}
+
+// nest starts sl as a child of n, sending its result to n's data. It reports
+// false if n no longer accepts children.
+func (r *run) nest(n *node, sl slot) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nested = true
+	if n.sealed {
+		return false
+	}
+	n.wg.Add(1)
+	e := r.claim(sl.name, n)
+	r.declare(sl)
+	t := r.track(sl.name)
+	prev, next := n.last, make(chan struct{})
+	n.last = next
+	r.spawn(func() {
+		defer n.wg.Done()
+		if sl.rows != nil {
+			r.list(n, sl, e, t, prev)
+		} else {
+			sc := r.produce(n.ctx, sl, e)
+			r.mark(&t.finished)
+			r.awaitTurn(n, sl, prev)
+			if r.send(n.data, sc) {
+				r.mark(&t.flushed)
+				r.metrics.slotSent(r.stream.metricsRoute, sl.name, time.Since(r.started))
+			}
+		}
+		close(next)
+		close(e.sent)
+	})
+	return true
+}
+
+// declare records that sl was nested, for Check.
+func (r *run) declare(sl slot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.declared = append(r.declared, sl)
+}
+
+// seal stops n accepting children and closes its data once every child has
+// been sent. It reports whether any children have been nested so far.
+func (r *run) seal(n *node) bool {
+	n.mu.Lock()
+	n.sealed = true
+	nested := n.nested
+	n.mu.Unlock()
+
+	r.spawn(func() {
+		n.wg.Wait()
+		close(n.data)
+	})
+	return nested
+}
+
+type result struct {
+	contents templ.Component
+	err      error
+	// key is the cache key of the result, if the slot is cached.
+	key    string
+	cached bool
+}
+
+// produce runs the slot's producer. A failed producer is logged, recorded for
+// the summary and rendered with the stream's error component. A producer that
+// runs past its timeout or the budget is abandoned in favour of its fallback.
+// Sub-slots nested by a successful producer stream through the returned
+// SlotContents' Children.
+func (r *run) produce(ctx context.Context, sl slot, e *entry) templates.SlotContents {
+	// Sub-slots are bounded by the budget rather than this slot's timeout, so
+	// they can keep streaming after the producer has returned.
+	children := newNode(context.WithCancel(ctx))
+	produceCtx := context.WithValue(ctx, scopeKey{}, &scope{run: r, node: children, entry: e})
+	if sl.timeout > 0 {
+		var cancel context.CancelFunc
+		produceCtx, cancel = context.WithTimeout(produceCtx, sl.timeout)
+		defer cancel()
+	}
+
+	done := make(chan result, 1)
+	r.spawn(func() {
+		defer r.producing(sl.name)()
+		done <- r.call(produceCtx, sl, e)
+	})
+
+	var res result
+	select {
+	case res = <-done:
+	case <-produceCtx.Done():
+		res.err = produceCtx.Err()
+	}
+	nested := r.seal(children)
+	if res.err != nil {
+		r.discard(children)
+		return r.fail(produceCtx, sl, e, res.err)
+	}
+
+	if sl.cache != nil && !res.cached && !nested {
+		sl.cache.store(res.key, sl.cachePolicy, res.contents, e.get())
+	}
+	e.finish(true)
+	sc := templates.SlotContents{Name: sl.name, Contents: res.contents}
+	if nested {
+		sc.Children = children.data
+	}
+	return sc
+}
+
+// fail records that sl's producer failed with err, or ran out of time if ctx
+// is done, and returns what to render in its place: its fallback, or the
+// stream's error component. A failure is logged, measured and recorded for the
+// summary.
+func (r *run) fail(ctx context.Context, sl slot, e *entry, err error) templates.SlotContents {
+	e.finish(false)
+	if ctx.Err() != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			log.Printf("stream: slot %q timed out", sl.name)
+			r.metrics.slotTimedOut(r.stream.metricsRoute, sl.name)
+		}
+		return templates.SlotContents{Name: sl.name, Contents: sl.fallback}
+	}
+	log.Printf("stream: slot %q failed: %v", sl.name, err)
+	r.metrics.slotFailed(r.stream.metricsRoute, sl.name)
+	r.mu.Lock()
+	r.errs = append(r.errs, templates.SlotContents{Name: sl.name, Err: err})
+	r.mu.Unlock()
+	return templates.SlotContents{Name: sl.name, Contents: r.stream.errorComponent(sl.name, err), Err: err}
+}
+
+// call runs sl's producer once its dependencies have resolved, unless the
+// slot's cache can answer instead. Coalesced slots share the run with other
+// requests.
+func (r *run) call(ctx context.Context, sl slot, e *entry) result {
+	if err := r.awaitDependencies(ctx, sl); err != nil {
+		return result{err: err}
+	}
+
+	var key string
+	if sl.cache != nil {
+		key = slotKey(sl.name, sl.cachePolicy.Params, Request(ctx))
+		if c, fresh, ok := sl.cache.lookup(key); ok {
+			if !fresh {
+				r.revalidate(ctx, sl, key)
+			}
+			e.set(c.value)
+			return result{contents: c.contents, key: key, cached: true}
+		}
+	}
+
+	var res result
+	if sl.group != nil {
+		res = r.callShared(ctx, sl, e)
+	} else {
+		res = r.invoke(ctx, sl)
+	}
+	res.key = key
+	return res
+}
+
+// discard cancels n's children and drains their results, for a slot whose
+// placeholders were never rendered.
+func (r *run) discard(n *node) {
+	n.cancel()
+	r.spawn(func() {
+		for range n.data {
+		}
+	})
+}
+
+// flatten forwards every slot sent to data, including nested ones, to a single
+// channel. A parent is always forwarded before its children, and siblings are
+// not held back while a subtree is streaming.
+func (r *run) flatten(data <-chan templates.SlotContents) <-chan templates.SlotContents {
+	out := make(chan templates.SlotContents)
+	var wg sync.WaitGroup
+	var forward func(data <-chan templates.SlotContents)
+	forward = func(data <-chan templates.SlotContents) {
+		defer wg.Done()
+		for sc := range data {
+			children := sc.Children
+			sc.Children = nil
+			r.send(out, sc)
+			if children != nil {
+				wg.Add(1)
+				r.spawn(func() { forward(children) })
+			}
+		}
+	}
+
+	wg.Add(1)
+	r.spawn(func() { forward(data) })
+	r.spawn(func() {
+		wg.Wait()
+		close(out)
+	})
+	return out
+}
+
+// send delivers sc to the body through data, giving up once the request is
+// over. It reports whether sc was delivered.
+func (r *run) send(data chan<- templates.SlotContents, sc templates.SlotContents) bool {
+	select {
+	case data <- sc:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+// footer lists the failed slots, connects live slots to their updates and, if
+// waterfall is set, renders the debug overlay. It is rendered after data is
+// closed, so it sees every slot.
+func (r *run) footer(waterfall bool) templ.Component {
+	return templ.ComponentFunc(func(ctx context.Context, w io.Writer) error {
+		r.mu.Lock()
+		errs := r.errs
+		r.mu.Unlock()
+		if err := templates.ErrorSummary(errs).Render(ctx, w); err != nil {
+			return err
+		}
+		if r.stream.live() {
+			if err := templates.Live().Render(ctx, w); err != nil {
+				return err
+			}
+		}
+		if !waterfall {
+			return nil
+		}
+		return templates.Waterfall(r.waterfall(), time.Since(r.started)).Render(ctx, w)
+	})
+}
@@ -0,0 +1,130 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Scheduler bounds how many slot producers run at once across every stream
+// that shares it. Slots waiting for their turn keep showing their placeholder,
+// and the time they spend queued counts towards their timeout.
+type Scheduler struct {
+	global chan struct{}
+
+	mu        sync.Mutex
+	routes    map[string]chan struct{}
+	queued    int
+	running   int
+	started   uint64
+	queueTime time.Duration
+}
+
+// SchedulerStats is a snapshot of a Scheduler's activity.
+type SchedulerStats struct {
+	// Queued is the number of producers waiting for their turn.
+	Queued int
+	// Running is the number of producers currently running.
+	Running int
+	// Started is the total number of producers that have been started.
+	Started uint64
+	// QueueTime is the total time that started producers spent queued.
+	QueueTime time.Duration
+}
+
+// NewScheduler creates a Scheduler that runs at most limit producers at once.
+// It panics if limit is less than 1, which would never run any.
+func NewScheduler(limit int) *Scheduler {
+	if limit < 1 {
+		panic(fmt.Sprintf("stream: NewScheduler called with limit %d, want at least 1", limit))
+	}
+	return &Scheduler{
+		global: make(chan struct{}, limit),
+		routes: make(map[string]chan struct{}),
+	}
+}
+
+// Quota limits how many producers of the named route may run at once, within
+// the scheduler's overall limit. Like NewScheduler, it panics if limit is less
+// than 1.
+func (s *Scheduler) Quota(route string, limit int) *Scheduler {
+	if limit < 1 {
+		panic(fmt.Sprintf("stream: Quota called with limit %d for route %q, want at least 1", limit, route))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.routes[route] = make(chan struct{}, limit)
+	return s
+}
+
+// Stats returns a snapshot of the scheduler's activity.
+func (s *Scheduler) Stats() SchedulerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SchedulerStats{
+		Queued:    s.queued,
+		Running:   s.running,
+		Started:   s.started,
+		QueueTime: s.queueTime,
+	}
+}
+
+// acquire waits until a producer of route may run, and returns the function
+// that releases its turn. It fails if ctx is done first.
+func (s *Scheduler) acquire(ctx context.Context, route string) (func(), error) {
+	s.mu.Lock()
+	quota := s.routes[route]
+	s.queued++
+	s.mu.Unlock()
+
+	start := time.Now()
+	err := s.take(ctx, quota)
+	if err == nil {
+		if err = s.take(ctx, s.global); err != nil && quota != nil {
+			<-quota
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued--
+	if err != nil {
+		return nil, err
+	}
+	s.running++
+	s.started++
+	s.queueTime += time.Since(start)
+
+	return func() {
+		<-s.global
+		if quota != nil {
+			<-quota
+		}
+		s.mu.Lock()
+		s.running--
+		s.mu.Unlock()
+	}, nil
+}
+
+// take waits for room in sem. A nil sem is unbounded.
+func (s *Scheduler) take(ctx context.Context, sem chan struct{}) error {
+	if sem == nil {
+		return nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WithScheduler runs the stream's producers on sched, counting them towards
+// the quota of route.
+func WithScheduler(sched *Scheduler, route string) Option {
+	return func(s *Stream) {
+		s.scheduler = sched
+		s.schedulerRoute = route
+	}
+}
@@ -0,0 +1,265 @@
+// Package stream renders pages whose slots are produced concurrently and
+// flushed to the client out of order, as soon as each one is ready.
+package stream
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/zackarysantana/goview/templates"
+)
+
+// Producer renders the contents of a single named slot. It should return once
+// ctx is done, when the slot has run out of time or the client has gone away.
+type Producer func(ctx context.Context) (templ.Component, error)
+
+// Layout wraps the streamed body in a complete HTML document. A layout that
+// also declares the assets it loads, as templates.Document does, has them
+// hinted to the browser before the page is rendered; see AssetLayout.
+type Layout interface {
+	Wrap(body templ.Component) templ.Component
+}
+
+// LayoutFunc adapts a function to a Layout that declares no assets.
+type LayoutFunc func(body templ.Component) templ.Component
+
+// Wrap returns f(body).
+func (f LayoutFunc) Wrap(body templ.Component) templ.Component {
+	return f(body)
+}
+
+// ErrorComponent renders the contents of a slot whose producer failed.
+type ErrorComponent func(name string, err error) templ.Component
+
+// Option configures a Stream.
+type Option func(*Stream)
+
+// WithErrorComponent sets the component rendered into a slot whose producer
+// returned an error. It defaults to templates.SlotError.
+func WithErrorComponent(ec ErrorComponent) Option {
+	return func(s *Stream) {
+		s.errorComponent = ec
+	}
+}
+
+// WithBudget bounds how long the whole body may keep streaming. Once d has
+// elapsed every unfilled slot is given its fallback and the body is closed.
+// The request then waits a little longer for the producers to return, and
+// leaves any that ignore their context running on their own.
+func WithBudget(d time.Duration) Option {
+	return func(s *Stream) {
+		s.budget = d
+	}
+}
+
+// WithStylesheets links the stylesheets at hrefs into the shadow roots of
+// Shadow mode pages, which the page's own stylesheets do not reach, so that
+// placeholders and the contents of slots that nest sub-slots are styled.
+func WithStylesheets(hrefs ...string) Option {
+	return func(s *Stream) {
+		s.stylesheets = append(s.stylesheets, hrefs...)
+	}
+}
+
+// Shell arranges the placeholders of the top-level slots, such as into a list.
+// placeholder returns the placeholder of the slot registered under name.
+type Shell func(placeholder func(name string) templ.Component) templ.Component
+
+// WithShell sets how the placeholders of the top-level slots are arranged. By
+// default they are rendered one after another, in the order the slots were
+// registered. A slot that the shell leaves out has nowhere to stream to, which
+// Check reports.
+func WithShell(shell Shell) Option {
+	return func(s *Stream) {
+		s.shell = shell
+	}
+}
+
+// SlotOption configures a single slot.
+type SlotOption func(*slot)
+
+// WithTimeout bounds how long the slot's producer may run before its fallback
+// is rendered instead.
+func WithTimeout(d time.Duration) SlotOption {
+	return func(sl *slot) {
+		sl.timeout = d
+	}
+}
+
+// WithFallback sets the component rendered into the slot when it times out or
+// the stream's budget runs out. It defaults to templates.SlotTimeout.
+func WithFallback(c templ.Component) SlotOption {
+	return func(sl *slot) {
+		sl.fallback = c
+	}
+}
+
+// WithPlaceholder sets the component rendered in place of the slot until it
+// arrives, such as one of the skeletons in templates sized like the slot's
+// contents, so that the page does not shift when they replace it. It defaults
+// to templates.Loading.
+func WithPlaceholder(c templ.Component) SlotOption {
+	return func(sl *slot) {
+		sl.placeholder = c
+	}
+}
+
+type slot struct {
+	name         string
+	produce      Producer
+	timeout      time.Duration
+	fallback     templ.Component
+	dependencies []string
+	subSlots     []string
+	cache        *Cache
+	cachePolicy  CachePolicy
+	group        *Group
+	groupParams  func(r *http.Request) string
+	watch        Watch
+	placeholder  templ.Component
+	rows         Rows
+	limit        int
+	count        bool
+	more         func(n int) templ.Component
+	retry        Retry
+}
+
+// Stream is an http.Handler that renders a layout with a placeholder for every
+// registered slot, runs the slot producers concurrently and flushes each result
+// into its placeholder as soon as it finishes.
+type Stream struct {
+	layout         Layout
+	errorComponent ErrorComponent
+	budget         time.Duration
+	mode           Mode
+	modeRules      []ModeRule
+	ordered        bool
+	scheduler      *Scheduler
+	schedulerRoute string
+	metrics        *Metrics
+	metricsRoute   string
+	serverTiming   bool
+	waterfallParam string
+	stylesheets    []string
+	shell          Shell
+	compression    bool
+	assets         []templates.Asset
+	earlyHints     bool
+	slots          []slot
+}
+
+// New creates a Stream that renders its slots inside layout.
+func New(layout Layout, opts ...Option) *Stream {
+	s := &Stream{
+		layout:         layout,
+		errorComponent: templates.SlotError,
+	}
+	if a, ok := layout.(AssetLayout); ok {
+		s.assets = a.Assets()
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+// Slot registers a named slot producer. Placeholders are rendered in the order
+// the slots were registered.
+func (s *Stream) Slot(name string, p Producer, opts ...SlotOption) *Stream {
+	s.slots = append(s.slots, newSlot(name, p, opts))
+	return s
+}
+
+func newSlot(name string, p Producer, opts []SlotOption) slot {
+	sl := slot{name: name, produce: p, fallback: templates.SlotTimeout(name)}
+	for _, o := range opts {
+		o(&sl)
+	}
+	return sl
+}
+
+// placeholders renders the placeholders of the top-level slots, arranged by the
+// stream's Shell.
+func (s *Stream) placeholders() templ.Component {
+	if s.shell == nil {
+		slots := make([]templ.Component, len(s.slots))
+		for i, sl := range s.slots {
+			slots[i] = placeholder(sl)
+		}
+		return templ.Join(slots...)
+	}
+	return s.shell(func(name string) templ.Component {
+		for _, sl := range s.slots {
+			if sl.name == name {
+				return placeholder(sl)
+			}
+		}
+		// A placeholder for a slot that is never registered is never filled,
+		// which Check reports.
+		return placeholder(newSlot(name, nil, nil))
+	})
+}
+
+type requestKey struct{}
+
+// Request returns the request being streamed, from the context passed to a
+// producer.
+func Request(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(requestKey{}).(*http.Request)
+	return r
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.live() && isEventStream(r) {
+		s.serveEvents(w, r)
+		return
+	}
+	s.hint(w, r)
+	w, done := s.compress(w, r)
+	defer done()
+
+	// Cancelling the run's context when the response ends, for whatever reason,
+	// and waiting for it means no producer outlives the request, unless it
+	// ignores its context past the budget.
+	ctx, cancel := context.WithCancel(context.WithValue(r.Context(), requestKey{}, r))
+	run := newRun(ctx, s)
+	run.metrics = s.metrics
+	run.start()
+	defer run.drain()
+	defer cancel()
+
+	s.metrics.startStream(s.metricsRoute)
+	defer s.metrics.endStream(s.metricsRoute)
+	w = &firstByteWriter{ResponseWriter: w, once: func() {
+		run.mark(&run.firstByte)
+		s.metrics.firstByte(s.metricsRoute, time.Since(run.started))
+	}}
+	if s.serverTiming {
+		w.Header().Add("Trailer", "Server-Timing")
+	}
+
+	var h *templ.ComponentHandler
+	placeholders := s.placeholders()
+	footer := run.footer(s.showWaterfall(r))
+	switch mode := s.modeFor(r); mode {
+	case Buffered:
+		resolved := make(map[string]templates.SlotContents)
+		resolve(run.root.data, resolved, nil)
+		body := withRender(templates.Inline(placeholders, footer), renderState{mode: mode, resolved: resolved})
+		h = templ.Handler(s.layout.Wrap(body))
+	case Script:
+		body := withRender(templates.Swaps(placeholders, run.flatten(run.root.data), footer), renderState{mode: mode})
+		h = templ.Handler(s.layout.Wrap(body), templ.WithStreaming())
+	default:
+		body := withRender(templates.Slots(placeholders, s.stylesheets, run.root.data, footer), renderState{mode: mode})
+		h = templ.Handler(s.layout.Wrap(body), templ.WithStreaming())
+	}
+	h.ServeHTTP(w, r)
+
+	if s.serverTiming {
+		w.Header().Set("Server-Timing", run.serverTiming())
+	}
+}
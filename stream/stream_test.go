@@ -0,0 +1,1373 @@
+package stream
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/andybalholm/brotli"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/zackarysantana/goview/templates"
+)
+
+// blocking is a producer that only returns once its context is done.
+func blocking(ctx context.Context) (templ.Component, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// checkGoroutines fails the test if the number of running goroutines does not
+// return to before within a second.
+func checkGoroutines(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines outlived the request:\n%s", runtime.NumGoroutine()-before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	// a and b each wait for the other to start, so they only finish if they
+	// run concurrently.
+	started := map[string]chan struct{}{"a": make(chan struct{}), "b": make(chan struct{})}
+	waitFor := func(self, other string, d time.Duration, c templ.Component) Producer {
+		return func(ctx context.Context) (templ.Component, error) {
+			close(started[self])
+			select {
+			case <-started[other]:
+			case <-time.After(time.Second):
+				return nil, errors.New(other + " did not run concurrently")
+			}
+			time.Sleep(d)
+			return c, nil
+		}
+	}
+	s := New(templates.Page).
+		Slot("a", waitFor("a", "b", 30*time.Millisecond, templates.A())).
+		Slot("b", waitFor("b", "a", 0, templates.C()))
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	body := stripProcess(w.Body.String())
+	if strings.Contains(body, "did not run concurrently") {
+		t.Fatalf("the producers did not run concurrently:\n%s", body)
+	}
+	// The placeholders are rendered in the order the slots were registered,
+	// and each result is flushed as soon as it is ready.
+	checkOrder(t, body,
+		`<slot name="a"><div>Loading a...</div></slot>`,
+		`<slot name="b"><div>Loading b...</div></slot>`,
+		`<div slot="b"><div>Component C.</div></div>`,
+		`<div slot="a"><div>Component A.</div></div>`,
+		`</html>`,
+	)
+}
+
+func TestServeHTTPClientDisconnect(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	s := New(templates.Page).
+		Slot("a", blocking).
+		Slot("b", blocking)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeHTTP(httptest.NewRecorder(), r)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ServeHTTP did not return after the client disconnected")
+	}
+	checkGoroutines(t, before)
+}
+
+// brokenWriter fails every write after the first, like a connection that
+// drops once the shell has been sent.
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *brokenWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes > 1 {
+		return 0, errors.New("broken pipe")
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestServeHTTPWriteError(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	// The request context is never cancelled, so only the stream itself can
+	// stop these producers once rendering fails.
+	s := New(templates.Page).
+		Slot("a", func(ctx context.Context) (templ.Component, error) {
+			return templates.A(), nil
+		}).
+		Slot("b", blocking)
+
+	w := &brokenWriter{ResponseRecorder: httptest.NewRecorder()}
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	checkGoroutines(t, before)
+}
+
+func TestErrors(t *testing.T) {
+	failing := func(msg string) Producer {
+		return func(ctx context.Context) (templ.Component, error) {
+			return nil, errors.New(msg)
+		}
+	}
+	s := New(templates.Page).
+		Slot("a", failing("a broke")).
+		Slot("b", after(0, templates.B(templ.NopComponent))).
+		Slot("c", failing("c broke"))
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		`<div class="text-red-500">Failed to load a: a broke</div>`,
+		`<div class="text-red-500">Failed to load c: c broke</div>`,
+		"Component B.",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("want %q in:\n%s", want, body)
+		}
+	}
+
+	// The summary lists each failed slot with its error, and nothing else.
+	i := strings.Index(body, `<div slot="goview-errors"`)
+	if i < 0 {
+		t.Fatalf("the error summary was not rendered:\n%s", body)
+	}
+	summary := body[i:]
+	summary = summary[:strings.Index(summary, "</ul>")]
+	for _, want := range []string{"2 section(s) failed to load", "<li>a: a broke</li>", "<li>c: c broke</li>"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("want %q in the error summary:\n%s", want, summary)
+		}
+	}
+	if strings.Contains(summary, "<li>b") {
+		t.Errorf("the error summary lists a slot that did not fail:\n%s", summary)
+	}
+
+	// The error component can be replaced, and a page without failures has no
+	// summary.
+	s = New(templates.Page, WithErrorComponent(func(name string, err error) templ.Component {
+		return templ.Raw("<p>" + name + " is unavailable</p>")
+	})).
+		Slot("a", failing("a broke"))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !strings.Contains(w.Body.String(), `<div slot="a"><p>a is unavailable</p>`) {
+		t.Errorf("the error component was not rendered into the slot:\n%s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	New(templates.Page).Slot("b", after(0, templates.C())).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if strings.Contains(w.Body.String(), `<div slot="goview-errors"`) {
+		t.Errorf("an error summary was rendered without any failures:\n%s", w.Body)
+	}
+
+	// A slot named like the summary does not clash with it.
+	w = httptest.NewRecorder()
+	New(templates.Page).Slot("errors", failing("errors broke")).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	body = w.Body.String()
+	if n := strings.Count(body, `<slot name="errors">`); n != 1 {
+		t.Errorf("got %d placeholders for slot errors, want 1:\n%s", n, body)
+	}
+	if !strings.Contains(body, `<div slot="goview-errors" class="text-red-500"><p>1 section(s) failed to load:</p><ul><li>errors: errors broke</li>`) {
+		t.Errorf("the error summary was not rendered into its own slot:\n%s", body)
+	}
+}
+
+func TestServeHTTPTimeouts(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	s := New(templates.Page, WithBudget(50*time.Millisecond)).
+		Slot("a", blocking, WithTimeout(10*time.Millisecond)).
+		Slot("b", blocking)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	checkGoroutines(t, before)
+
+	for _, name := range []string{"a", "b"} {
+		if !strings.Contains(w.Body.String(), name+" is taking too long to load.") {
+			t.Errorf("slot %q did not render its fallback:\n%s", name, w.Body)
+		}
+	}
+}
+
+func TestBudgetIgnoredContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s := New(templates.Page, WithBudget(50*time.Millisecond)).
+		Slot("a", func(ctx context.Context) (templ.Component, error) {
+			// a ignores its context, so it outlives the budget.
+			<-release
+			return templates.A(), nil
+		}).
+		Slot("b", after(0, templates.C()))
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond+budgetGrace+200*time.Millisecond {
+		t.Errorf("the request took %v, waiting for a producer past its budget", elapsed)
+	}
+	body := stripProcess(w.Body.String())
+	checkOrder(t, body,
+		`<div slot="b"><div>Component C.</div></div>`,
+		`<div slot="a"><div class="text-gray-500">a is taking too long to load.</div></div>`,
+		`</html>`,
+	)
+}
+
+func TestFallbacks(t *testing.T) {
+	s := New(templates.Page, WithBudget(80*time.Millisecond)).
+		Slot("a", blocking, WithTimeout(10*time.Millisecond), WithFallback(templ.Raw("<p>a gave up</p>"))).
+		Slot("b", blocking).
+		Slot("c", after(0, templates.C()))
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the stream took %v, past its budget", elapsed)
+	}
+
+	// Each slot is given its fallback once its own timeout or the budget runs
+	// out, and the body is still closed.
+	body := stripProcess(w.Body.String())
+	checkOrder(t, body,
+		`<div slot="c"><div>Component C.</div></div>`,
+		`<div slot="a"><p>a gave up</p></div>`,
+		`<div slot="b"><div class="text-gray-500">b is taking too long to load.</div></div>`,
+		`</html>`,
+	)
+	// Running out of time is not a failure.
+	if strings.Contains(body, `<div slot="goview-errors"`) {
+		t.Errorf("timed out slots were summarised as failures:\n%s", body)
+	}
+}
+
+func TestNest(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	s := New(templates.Page).
+		Slot("a", func(ctx context.Context) (templ.Component, error) {
+			details := Nest(ctx, "details", func(ctx context.Context) (templ.Component, error) {
+				return templates.Details(), nil
+			})
+			return templates.B(details), nil
+		}).
+		Slot("b", func(ctx context.Context) (templ.Component, error) {
+			// The failed parent's placeholder is never rendered, so its
+			// sub-slot must be cancelled rather than left blocking.
+			Nest(ctx, "orphan", blocking)
+			return nil, errors.New("boom")
+		})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	checkGoroutines(t, before)
+
+	body := stripProcess(w.Body.String())
+	want := `<div slot="details"><div>Details of B.</div></div></div>`
+	if !strings.Contains(body, want) {
+		t.Errorf("sub-slot was not streamed inside its parent, want %q in:\n%s", want, body)
+	}
+	if strings.Contains(body, `slot="orphan"`) {
+		t.Errorf("sub-slot of a failed slot was rendered:\n%s", body)
+	}
+}
+
+func TestBuffered(t *testing.T) {
+	s := New(templates.Page, WithModeRules(QueryMode("render"))).
+		Slot("a", func(ctx context.Context) (templ.Component, error) {
+			details := Nest(ctx, "details", func(ctx context.Context) (templ.Component, error) {
+				return templates.Details(), nil
+			})
+			return templates.B(details), nil
+		})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?render=buffered", nil))
+
+	body := stripProcess(w.Body.String())
+	if strings.Contains(body, "<slot") || strings.Contains(body, "Loading") {
+		t.Errorf("buffered body contains placeholders:\n%s", body)
+	}
+	want := `<div data-slot="a"><div>Component B.</div><div data-slot="details"><div>Details of B.</div></div></div>`
+	if !strings.Contains(body, want) {
+		t.Errorf("want %q in:\n%s", want, body)
+	}
+}
+
+func TestScript(t *testing.T) {
+	s := New(templates.Page, WithMode(Script)).
+		Slot("a", func(ctx context.Context) (templ.Component, error) {
+			details := Nest(ctx, "details", func(ctx context.Context) (templ.Component, error) {
+				time.Sleep(50 * time.Millisecond)
+				return templates.Details(), nil
+			})
+			return templates.B(details), nil
+		}).
+		Slot("b", func(ctx context.Context) (templ.Component, error) {
+			time.Sleep(10 * time.Millisecond)
+			return templates.A(), nil
+		})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	body := stripProcess(w.Body.String())
+	if strings.Contains(body, "<slot") || strings.Contains(body, "shadowrootmode") {
+		t.Errorf("script body uses shadow DOM:\n%s", body)
+	}
+	// A sibling is not held back while a subtree is still streaming.
+	checkOrder(t, body, `id="slot-details"`, `goviewSwap("a")`, `goviewSwap("b")`, `goviewSwap("details")`)
+}
+
+// after returns a producer that renders c after d.
+func after(d time.Duration, c templ.Component) Producer {
+	return func(ctx context.Context) (templ.Component, error) {
+		time.Sleep(d)
+		return c, nil
+	}
+}
+
+// processSlot is the script that initialises htmx in each streamed slot.
+const processSlot = "<script>goviewProcess(document.currentScript.parentElement);</script>"
+
+// stripProcess removes the processSlot scripts from body.
+func stripProcess(body string) string {
+	return strings.NewReplacer(" "+processSlot, "", processSlot, "").Replace(body)
+}
+
+// checkOrder fails the test unless every string in order appears in body, in
+// that order.
+func checkOrder(t *testing.T, body string, order ...string) {
+	t.Helper()
+	last := -1
+	for _, want := range order {
+		i := strings.Index(body, want)
+		if i <= last {
+			t.Fatalf("want %q in order %q in:\n%s", want, order, body)
+		}
+		last = i
+	}
+}
+
+func TestDocumentOrder(t *testing.T) {
+	s := New(templates.Page, WithDocumentOrder()).
+		Slot("a", after(30*time.Millisecond, templates.A())).
+		Slot("b", after(0, templates.C()))
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	checkOrder(t, w.Body.String(), `<div slot="a">`, `<div slot="b">`)
+}
+
+func TestDependencies(t *testing.T) {
+	s := New(templates.Page).
+		Slot("summary", func(ctx context.Context) (templ.Component, error) {
+			module, ok := Value[string](ctx, "module")
+			if !ok {
+				return nil, errors.New("module is not resolved")
+			}
+			return templ.Raw(module), nil
+		}, WithDependencies("module")).
+		Slot("module", func(ctx context.Context) (templ.Component, error) {
+			time.Sleep(30 * time.Millisecond)
+			SetValue(ctx, "github.com/zackarysantana/goview")
+			return templates.A(), nil
+		}).
+		Slot("broken", func(ctx context.Context) (templ.Component, error) {
+			return nil, errors.New("boom")
+		}).
+		Slot("dependent", after(0, templates.C()), WithDependencies("broken"))
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	body := stripProcess(w.Body.String())
+	checkOrder(t, body, `<div slot="module">`, `<div slot="summary">github.com/zackarysantana/goview</div>`)
+	if !strings.Contains(body, `<li>dependent: stream: dependency did not resolve: &#34;broken&#34;</li>`) {
+		t.Errorf("slot with a failed dependency did not fail:\n%s", body)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	sched := NewScheduler(4).Quota("/", 1)
+
+	var mu sync.Mutex
+	running, peak := 0, 0
+	counted := func(ctx context.Context) (templ.Component, error) {
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return templates.A(), nil
+	}
+	s := New(templates.Page, WithScheduler(sched, "/")).
+		Slot("a", counted).
+		Slot("b", counted).
+		Slot("c", counted)
+
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if peak != 1 {
+		t.Errorf("%d producers ran at once, want 1", peak)
+	}
+	stats := sched.Stats()
+	if stats.Started != 3 || stats.Running != 0 || stats.Queued != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats.QueueTime < 10*time.Millisecond {
+		t.Errorf("queue time %s is shorter than a producer's run", stats.QueueTime)
+	}
+
+	// A limit that would never run any producer is refused.
+	for name, f := range map[string]func(){
+		"NewScheduler(0)": func() { NewScheduler(0) },
+		"Quota(0)":        func() { NewScheduler(1).Quota("/", 0) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s did not panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func TestCache(t *testing.T) {
+	cache := NewCache(8)
+	var clock sync.Mutex
+	now := time.Now()
+	cache.now = func() time.Time {
+		clock.Lock()
+		defer clock.Unlock()
+		return now
+	}
+	var mu sync.Mutex
+	calls := 0
+	s := New(templates.Page).
+		Slot("a", func(ctx context.Context) (templ.Component, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			return templ.Raw(fmt.Sprintf("call %d", calls)), nil
+		}, WithCache(cache, CachePolicy{TTL: time.Minute, Stale: time.Hour, Params: QueryParams("pkg")}))
+
+	render := func(target string) string {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return stripProcess(w.Body.String())
+	}
+	get := func(target, want string) {
+		t.Helper()
+		if body := render(target); !strings.Contains(body, `<div slot="a">`+want+`</div>`) {
+			t.Fatalf("GET %s: want %q in:\n%s", target, want, body)
+		}
+	}
+
+	get("/?pkg=a", "call 1")
+	get("/?pkg=a", "call 1")
+	get("/?pkg=b", "call 2")
+
+	// A stale result is served while it is refreshed in the background.
+	clock.Lock()
+	now = now.Add(2 * time.Minute)
+	clock.Unlock()
+	get("/?pkg=a", "call 1")
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(render("/?pkg=a"), `<div slot="a">call 3</div>`) {
+		if time.Now().After(deadline) {
+			t.Fatal("the stale result was not refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cache.InvalidateSlot("a")
+	get("/?pkg=b", "call 4")
+}
+
+func TestCoalescing(t *testing.T) {
+	g := NewGroup()
+	var mu sync.Mutex
+	calls := 0
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	s := New(templates.Page).
+		Slot("a", func(ctx context.Context) (templ.Component, error) {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+			started <- struct{}{}
+			select {
+			case <-release:
+				return templates.A(), nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}, WithCoalescing(g, nil))
+	// waiters returns how many requests are waiting for the shared run.
+	waiters := func() int {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		for _, f := range g.calls {
+			return f.waiters
+		}
+		return 0
+	}
+
+	// The first client disconnects once the second has joined its run, which
+	// must not abort the run for the second.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan struct{})
+	go func() {
+		defer close(first)
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	second := make(chan struct{})
+	go func() {
+		defer close(second)
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+	deadline := time.Now().Add(time.Second)
+	for waiters() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the second request did not join the shared run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-first
+	close(release)
+	<-second
+
+	if !strings.Contains(stripProcess(w.Body.String()), `<div slot="a"><div>Component A.</div></div>`) {
+		t.Errorf("coalesced slot was not rendered:\n%s", w.Body)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("producer ran %d times, want 1", calls)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	// The scheduler's route does not replace the metrics'.
+	s := New(templates.Page, WithMetrics(m, "/page"), WithScheduler(NewScheduler(4).Quota("/sched", 1), "/sched")).
+		Slot("a", after(0, templates.A())).
+		Slot("b", func(ctx context.Context) (templ.Component, error) {
+			return nil, errors.New("boom")
+		}).
+		Slot("c", blocking, WithTimeout(time.Millisecond))
+
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/page", nil))
+	// Partials and checks are not measured.
+	s.Partials("/slot/").ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slot/a", nil))
+	s.Check(httptest.NewRequest(http.MethodGet, "/page", nil))
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`goview_time_to_first_byte_seconds_count{route="/page"} 1`,
+		`goview_slot_duration_seconds_count{route="/page",slot="a"} 1`,
+		`goview_slot_errors_total{route="/page",slot="b"} 1`,
+		`goview_slot_timeouts_total{route="/page",slot="c"} 1`,
+		`goview_streams_in_flight{route="/page"} 0`,
+	} {
+		if !strings.Contains(w.Body.String(), want+"\n") {
+			t.Errorf("want %q in:\n%s", want, w.Body)
+		}
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	s := New(templates.Page, WithServerTiming(), WithWaterfall("debug")).
+		Slot("a", after(0, templates.A()))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/?debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Trailers are only available once the body has been read.
+	if got := resp.Trailer.Get("Server-Timing"); !strings.Contains(got, "shell;dur=") || !strings.Contains(got, "slot-a;dur=") {
+		t.Errorf("unexpected Server-Timing trailer %q", got)
+	}
+	if !strings.Contains(string(body), `<div slot="goview-debug"`) {
+		t.Errorf("waterfall was not rendered:\n%s", body)
+	}
+}
+
+func TestLive(t *testing.T) {
+	updates := make(chan struct{})
+	var mu sync.Mutex
+	renders := 0
+	s := New(templates.Page).
+		Slot("status", func(ctx context.Context) (templ.Component, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			renders++
+			return templ.Raw(fmt.Sprintf("<p>render %d</p>\n<p>done</p>", renders)), nil
+		}, WithUpdates(func(ctx context.Context) <-chan struct{} { return updates }))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !strings.Contains(w.Body.String(), "new EventSource(location.href)") {
+		t.Errorf("page does not connect to its updates:\n%s", w.Body)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected Content-Type %q", ct)
+	}
+
+	updates <- struct{}{}
+	want := "data: status\ndata: <p>render 2</p>\ndata: <p>done</p>\n\n"
+	buf := make([]byte, 0, 256)
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(string(buf), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("want event %q in:\n%s", want, buf)
+		}
+		chunk := make([]byte, 256)
+		n, err := resp.Body.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		if err != nil {
+			t.Fatalf("reading events: %v\n%s", err, buf)
+		}
+	}
+}
+
+func TestPartials(t *testing.T) {
+	s := New(templates.Page).
+		Slot("module", func(ctx context.Context) (templ.Component, error) {
+			SetValue(ctx, "github.com/zackarysantana/goview")
+			return templates.A(), nil
+		}).
+		Slot("summary", func(ctx context.Context) (templ.Component, error) {
+			module, _ := Value[string](ctx, "module")
+			details := Nest(ctx, "details", after(0, templates.Details()))
+			return templ.Join(templ.Raw(module), details), nil
+		}, WithDependencies("module")).
+		Slot("broken", func(ctx context.Context) (templ.Component, error) {
+			return nil, errors.New("boom")
+		})
+	h := s.Partials("/slot/")
+
+	for _, tt := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/slot/summary", http.StatusOK, `github.com/zackarysantana/goview<div data-slot="details"><div>Details of B.</div></div>`},
+		{"/slot/broken", http.StatusInternalServerError, "Failed to load broken: boom"},
+		{"/slot/missing", http.StatusNotFound, "404 page not found"},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("GET %s: got status %d, want %d", tt.path, w.Code, tt.status)
+		}
+		if !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("GET %s: want %q in:\n%s", tt.path, tt.body, w.Body)
+		}
+		if strings.Contains(w.Body.String(), "<html") {
+			t.Errorf("GET %s: partial was rendered inside the layout:\n%s", tt.path, w.Body)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	module := NewKey[string]("module")
+	summary := NewKey[struct{}]("summary")
+	details := NewKey[struct{}]("details")
+
+	good := New(templates.Page).
+		Slot(module.Name(), func(ctx context.Context) (templ.Component, error) {
+			module.Set(ctx, "github.com/zackarysantana/goview")
+			return templates.A(), nil
+		}).
+		Slot(summary.Name(), func(ctx context.Context) (templ.Component, error) {
+			m, _ := module.Value(ctx)
+			return templ.Join(templ.Raw(m), details.Nest(ctx, after(0, templates.Details()))), nil
+		}, WithDependencies(module.Name()))
+	if err := good.Check(httptest.NewRequest(http.MethodGet, "/", nil)); err != nil {
+		t.Errorf("unexpected error for a well-wired stream: %v", err)
+	}
+
+	bad := New(templates.Page).
+		Slot("a", after(0, templates.A())).
+		Slot("a", after(0, templates.A())).
+		Slot("b", func(ctx context.Context) (templ.Component, error) {
+			// The placeholder is dropped, so the details have nowhere to go.
+			Nest(ctx, "details", after(0, templates.Details()))
+			return templ.Join(templates.C(), Nest(ctx, templates.DebugSlot, after(0, templates.Details()))), nil
+		}).
+		Slot("c", after(0, templates.C()), WithDependencies("missing"), WithTimeout(10*time.Millisecond))
+	err := bad.Check(httptest.NewRequest(http.MethodGet, "/", nil))
+	for _, want := range []string{
+		`stream: slot "a" is streamed 2 times`,
+		`stream: slot "a" has 2 placeholders`,
+		`stream: slot "details" is streamed but its placeholder is never rendered`,
+		`stream: slot "goview-debug" uses a name reserved for the error summary and waterfall`,
+		`stream: slot "c" depends on "missing", which is never streamed`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("want %q in error: %v", want, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	module := NewKey[string]("module")
+	summary := NewKey[struct{}]("summary")
+	details := NewKey[struct{}]("details")
+	ran := false
+	never := func(ctx context.Context) (templ.Component, error) {
+		ran = true
+		return templates.A(), nil
+	}
+
+	good := New(templates.Page)
+	SlotFor(good, module, never)
+	SlotFor(good, summary, never, DependsOn(module), WithSubSlots(details))
+	SlotFor(good, NewKey[struct{}]("footer"), never, DependsOn(details))
+	if err := good.Validate(); err != nil {
+		t.Errorf("unexpected error for a well-wired stream: %v", err)
+	}
+
+	bad := New(templates.Page).
+		Slot("a", never).
+		Slot("a", never, WithSubSlots(details)).
+		Slot("b", never, WithDependencies("c", "missing")).
+		Slot("c", never, WithDependencies("d")).
+		Slot("d", never, WithDependencies("b")).
+		Slot(templates.ErrorsSlot, never)
+	err := bad.Validate()
+	for _, want := range []string{
+		`stream: slot "a" is declared 2 times`,
+		`stream: slot "goview-errors" uses a name reserved for the error summary and waterfall`,
+		`stream: slot "b" depends on "missing", which is never declared`,
+		`stream: slots depend on each other in a cycle: b -> c -> d -> b`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("want %q in error: %v", want, err)
+		}
+	}
+	if ran {
+		t.Error("Validate ran a producer")
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	newStream := func(m Mode) *Stream {
+		return New(templates.Page, WithMode(m), WithStylesheets("/assets/styles.css")).
+			Slot("a", func(ctx context.Context) (templ.Component, error) {
+				details := Nest(ctx, "details", after(0, templates.Details()), WithPlaceholder(templates.SkeletonBlock("h-8 w-full")))
+				return templates.B(details), nil
+			}, WithPlaceholder(templates.SkeletonText(2))).
+			Slot("b", after(0, templates.C()))
+	}
+
+	w := httptest.NewRecorder()
+	newStream(Shadow).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	checkOrder(t, w.Body.String(),
+		`<template shadowrootmode="open"><link rel="stylesheet" href="/assets/styles.css">`,
+		`<slot name="a"><div role="status" aria-label="Loading" class="animate-pulse space-y-2">`,
+		`<slot name="b"><div>Loading b...</div></slot>`,
+		`<div slot="a"><template shadowrootmode="open"><link rel="stylesheet" href="/assets/styles.css">`,
+		`<slot name="details"><div role="status" aria-label="Loading" class="animate-pulse rounded bg-gray-200 h-8 w-full"></div></slot>`,
+	)
+
+	w = httptest.NewRecorder()
+	newStream(Script).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	checkOrder(t, w.Body.String(),
+		`<div id="slot-a"><div role="status" aria-label="Loading" class="animate-pulse space-y-2">`,
+		`<div id="slot-b"><div>Loading b...</div></div>`,
+		`<div id="slot-details"><div role="status" aria-label="Loading" class="animate-pulse rounded bg-gray-200 h-8 w-full"></div></div>`,
+	)
+}
+
+func TestShell(t *testing.T) {
+	list := func(placeholder func(name string) templ.Component) templ.Component {
+		return templates.List([]templ.Component{placeholder("a"), placeholder("b")})
+	}
+	newStream := func(m Mode) *Stream {
+		return New(templates.Page, WithMode(m), WithShell(list)).
+			Slot("a", after(0, templates.A())).
+			Slot("b", after(0, templates.C()))
+	}
+	for m, want := range map[Mode][]string{
+		Shadow:   {`<ul><li><slot name="a">`, `</slot></li><li><slot name="b">`, `</slot></li></ul>`},
+		Script:   {`<ul><li><div id="slot-a">`, `</div></li><li><div id="slot-b">`, `</div></li></ul>`},
+		Buffered: {`<ul><li><div data-slot="a"><div>Component A.</div></div></li><li><div data-slot="b">`},
+	} {
+		w := httptest.NewRecorder()
+		newStream(m).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		checkOrder(t, w.Body.String(), want...)
+	}
+
+	// Check reports the slots a shell leaves out, and the placeholders it adds
+	// for slots that are never registered.
+	s := New(templates.Page, WithShell(func(placeholder func(name string) templ.Component) templ.Component {
+		return templ.Join(placeholder("a"), placeholder("x"))
+	})).
+		Slot("a", after(0, templates.A())).
+		Slot("b", after(0, templates.C()))
+	err := s.Check(httptest.NewRequest(http.MethodGet, "/", nil))
+	for _, want := range []string{
+		`stream: slot "b" is streamed but its placeholder is never rendered`,
+		`stream: placeholder "x" is never filled`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("want %q in error: %v", want, err)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	release := make(chan struct{})
+	var produced atomic.Int32
+	rows := func(ctx context.Context) iter.Seq2[templ.Component, error] {
+		return func(yield func(templ.Component, error) bool) {
+			for i := range 5 {
+				produced.Add(1)
+				if !yield(templ.Raw(fmt.Sprintf("<p>row %d</p>", i)), nil) {
+					return
+				}
+				if i == 0 {
+					// Hold the rest back until the first row has reached the client.
+					select {
+					case <-release:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}
+	s := New(templates.Page).List("rows", rows, WithLimit(3))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body []byte
+	for !strings.Contains(string(body), "<p>row 0</p>") {
+		chunk := make([]byte, 1024)
+		n, err := resp.Body.Read(chunk)
+		body = append(body, chunk[:n]...)
+		if err != nil {
+			t.Fatalf("the first row was not streamed before the rest were produced: %v\n%s", err, body)
+		}
+	}
+	close(release)
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = append(body, rest...)
+	checkOrder(t, stripProcess(string(body)),
+		`<div slot="rows"><p>row 0</p></div>`,
+		`<div slot="rows"><p>row 1</p></div>`,
+		`<div slot="rows"><p>row 2</p></div>`,
+		`<div slot="rows"><div class="text-gray-500">More...</div></div>`,
+	)
+	if strings.Contains(string(body), "row 3") {
+		t.Errorf("rows past the limit were rendered:\n%s", body)
+	}
+	if n := produced.Load(); n != 4 {
+		t.Errorf("%d rows were produced, want the 3 rendered and 1 past the limit", n)
+	}
+
+	// Counting the rows past the limit produces all of them.
+	counted := New(templates.Page).List("rows", rows, WithLimit(3), WithCount())
+	w := httptest.NewRecorder()
+	counted.Partials("/slot/").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/slot/rows", nil))
+	if want := `<p>row 0</p><p>row 1</p><p>row 2</p><div class="text-gray-500">2 more...</div>`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("want %q in partial:\n%s", want, w.Body)
+	}
+	w = httptest.NewRecorder()
+	counted.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if want := `<div slot="rows"><div class="text-gray-500">2 more...</div></div>`; !strings.Contains(stripProcess(w.Body.String()), want) {
+		t.Errorf("want %q in:\n%s", want, w.Body)
+	}
+	if err := s.Check(httptest.NewRequest(http.MethodGet, "/", nil)); err != nil {
+		t.Errorf("unexpected error checking a list: %v", err)
+	}
+
+	failing := func(ctx context.Context) iter.Seq2[templ.Component, error] {
+		return func(yield func(templ.Component, error) bool) {
+			if yield(templ.Raw("<p>row 0</p>"), nil) {
+				yield(nil, errors.New("boom"))
+			}
+		}
+	}
+	w = httptest.NewRecorder()
+	New(templates.Page, WithMode(Buffered)).
+		List("rows", failing).
+		ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if want := `<div data-slot="rows"><p>row 0</p><div class="text-red-500">Failed to load rows: boom</div></div>`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("want %q in:\n%s", want, w.Body)
+	}
+
+	items := Channel(func(ctx context.Context) <-chan templ.Component {
+		ch := make(chan templ.Component)
+		go func() {
+			defer close(ch)
+			for _, c := range []templ.Component{templates.A(), templates.C()} {
+				select {
+				case ch <- c:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return ch
+	})
+	w = httptest.NewRecorder()
+	New(templates.Page, WithMode(Script)).
+		List("rows", items).
+		ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	checkOrder(t, w.Body.String(),
+		`<div hidden id="slot-chunk-rows"><div>Component A.</div></div><script>goviewSwap("rows")</script>`,
+		`<div hidden id="slot-chunk-rows"><div>Component C.</div></div><script>goviewAppend("rows")</script>`,
+	)
+}
+
+func TestPanics(t *testing.T) {
+	panicking := func(ctx context.Context) iter.Seq2[templ.Component, error] {
+		return func(yield func(templ.Component, error) bool) {
+			if yield(templ.Raw("<p>row 0</p>"), nil) {
+				panic("list boom")
+			}
+		}
+	}
+	w := httptest.NewRecorder()
+	New(templates.Page).
+		Slot("a", func(ctx context.Context) (templ.Component, error) {
+			panic("boom")
+		}).
+		List("rows", panicking).
+		Slot("b", after(0, templates.C())).
+		ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	body := stripProcess(w.Body.String())
+	for _, want := range []string{
+		`<div slot="a"><div class="text-red-500">Failed to load a: stream: producer panicked: boom</div></div>`,
+		`<div slot="b"><div>Component C.</div></div>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("want %q in:\n%s", want, body)
+		}
+	}
+	checkOrder(t, body,
+		`<div slot="rows"><p>row 0</p></div>`,
+		`<div slot="rows"><div class="text-red-500">Failed to load rows: stream: producer panicked: list boom</div></div>`,
+	)
+}
+
+func TestRetry(t *testing.T) {
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	failing := func(name string, failures int, err error) Producer {
+		return func(ctx context.Context) (templ.Component, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls[name]++
+			if calls[name] <= failures {
+				if err == nil {
+					panic("boom")
+				}
+				return nil, err
+			}
+			return templates.A(), nil
+		}
+	}
+	retry := WithRetry(Exponential(3, time.Millisecond))
+
+	w := httptest.NewRecorder()
+	New(templates.Page, WithMode(Buffered)).
+		Slot("flaky", failing("flaky", 2, errors.New("flaky")), retry).
+		Slot("broken", failing("broken", 3, errors.New("broken")), retry).
+		Slot("permanent", failing("permanent", 1, backoff.Permanent(errors.New("permanent"))), retry).
+		Slot("panicking", failing("panicking", 1, nil), retry).
+		ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	for _, want := range []string{
+		`<div data-slot="flaky"><div>Component A.</div></div>`,
+		`<div data-slot="broken"><div class="text-red-500">Failed to load broken: broken</div></div>`,
+		`<div data-slot="permanent"><div class="text-red-500">Failed to load permanent: permanent</div></div>`,
+		`<div data-slot="panicking"><div class="text-red-500">Failed to load panicking: stream: producer panicked: boom</div></div>`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("want %q in:\n%s", want, w.Body)
+		}
+	}
+	for name, want := range map[string]int{"flaky": 3, "broken": 3, "permanent": 1, "panicking": 1} {
+		if calls[name] != want {
+			t.Errorf("%s: got %d calls, want %d", name, calls[name], want)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, tt := range []struct {
+		encoding string
+		reader   func(io.Reader) (io.Reader, error)
+	}{
+		{"br", func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil }},
+		{"gzip", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+	} {
+		t.Run(tt.encoding, func(t *testing.T) {
+			release := make(chan struct{})
+			s := New(templates.Page, WithCompression()).
+				Slot("a", after(0, templates.A())).
+				Slot("b", func(ctx context.Context) (templ.Component, error) {
+					// b is only produced once a has reached the client on its own.
+					select {
+					case <-release:
+						return templates.C(), nil
+					case <-ctx.Done():
+						return nil, ctx.Err()
+					}
+				}, WithTimeout(2*time.Second))
+			srv := httptest.NewServer(s)
+			defer srv.Close()
+
+			req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept-Encoding", "gzip;q=0.9, "+tt.encoding)
+			resp, err := (&http.Client{Transport: &http.Transport{DisableCompression: true}}).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if got := resp.Header.Get("Content-Encoding"); got != tt.encoding {
+				t.Fatalf("got Content-Encoding %q, want %q", got, tt.encoding)
+			}
+
+			zr, err := tt.reader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body []byte
+			for !strings.Contains(string(body), "Component A.") {
+				chunk := make([]byte, 1024)
+				n, err := zr.Read(chunk)
+				body = append(body, chunk[:n]...)
+				if err != nil {
+					t.Fatalf("slot a was not flushed through the compressor on its own: %v\n%s", err, body)
+				}
+			}
+			close(release)
+			rest, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = append(body, rest...)
+			checkOrder(t, stripProcess(string(body)),
+				`<div slot="a"><div>Component A.</div></div>`,
+				`<div slot="b"><div>Component C.</div></div>`,
+				`</html>`,
+			)
+		})
+	}
+
+	for accept, want := range map[string]string{
+		"":                        "",
+		"identity":                "",
+		"gzip, deflate":           "gzip",
+		"gzip, br":                "br",
+		"br;q=0.5, gzip":          "gzip",
+		"br;q=0, gzip;q=0":        "",
+		"GZIP;q=0.8, br;q=0.8":    "br",
+		"deflate, br;q=bad, gzip": "gzip",
+	} {
+		if got := negotiate(accept); got != want {
+			t.Errorf("negotiate(%q) = %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestEarlyHints(t *testing.T) {
+	hinted := make(chan struct{})
+	s := New(templates.Page, WithEarlyHints()).
+		Slot("a", func(ctx context.Context) (templ.Component, error) {
+			// a is only produced once the hints have reached the client.
+			select {
+			case <-hinted:
+				return templates.A(), nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}, WithTimeout(2*time.Second))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	want := []string{
+		"</assets/htmx.min.js>; rel=preload; as=script",
+		"</assets/styles.css>; rel=preload; as=style",
+	}
+
+	var hints []string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code != http.StatusEarlyHints {
+				return nil
+			}
+			hints = header.Values("Link")
+			close(hinted)
+			return nil
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "Component A.") {
+		t.Errorf("slot a was not produced:\n%s", body)
+	}
+	if fmt.Sprint(hints) != fmt.Sprint(want) {
+		t.Errorf("got early hints %q, want %q", hints, want)
+	}
+	// The page repeats them for clients that ignore 1xx responses.
+	if got := resp.Header.Values("Link"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got Link headers %q, want %q", got, want)
+	}
+
+	// HTTP/1.0 has no 1xx responses, so the page is the first response.
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.0\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d over HTTP/1.0, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Header.Values("Link"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got Link headers %q over HTTP/1.0, want %q", got, want)
+	}
+
+	// Without early hints, the assets are only linked from the page.
+	w := httptest.NewRecorder()
+	New(templates.Page).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d without early hints, want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Values("Link"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got Link headers %q without early hints, want %q", got, want)
+	}
+
+	// A layout that declares no assets hints none.
+	w = httptest.NewRecorder()
+	New(LayoutFunc(templates.Page.Wrap), WithEarlyHints()).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := w.Header().Values("Link"); len(got) != 0 {
+		t.Errorf("got Link headers %q from a layout without assets, want none", got)
+	}
+}
+
+func TestLoader(t *testing.T) {
+	var mu sync.Mutex
+	var batches []string
+	fail := true
+	l := NewLoader(20*time.Millisecond, func(ctx context.Context, keys []string) (map[string]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		sorted := slices.Sorted(slices.Values(keys))
+		batches = append(batches, strings.Join(sorted, ","))
+		if slices.Contains(keys, "flaky") && fail {
+			fail = false
+			return nil, errors.New("flaky failed")
+		}
+		if slices.Contains(keys, "slow") {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		values := make(map[string]string)
+		for _, k := range keys {
+			if k != "missing" {
+				values[k] = strings.ToUpper(k)
+			}
+		}
+		return values, nil
+	})
+	loading := func(key string) Producer {
+		return func(ctx context.Context) (templ.Component, error) {
+			v, err := l.Load(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			return templ.Raw("<p>" + v + "</p>"), nil
+		}
+	}
+	reset := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		b := batches
+		batches = nil
+		return b
+	}
+
+	// Every slot's keys are loaded in one batch, and the later slot reads the
+	// memoized value.
+	s := New(templates.Page, WithMode(Buffered)).
+		Slot("a", loading("x")).
+		Slot("b", loading("x")).
+		Slot("c", loading("y")).
+		Slot("d", loading("x"), WithDependencies("a"))
+	for range 2 {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if got := strings.Count(w.Body.String(), "<p>X</p>"); got != 3 {
+			t.Errorf("got %d slots with X, want 3:\n%s", got, w.Body)
+		}
+		// Each request has loads of its own.
+		if got := reset(); !slices.Equal(got, []string{"x,y"}) {
+			t.Errorf("got batches %q, want one of x and y", got)
+		}
+	}
+
+	ctx := withLoads(context.Background(), nil)
+	if _, err := l.Load(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v for a missing key, want ErrNotFound", err)
+	}
+
+	// Failed loads are tried again.
+	if _, err := l.Load(ctx, "flaky"); err == nil {
+		t.Error("the first load of flaky did not fail")
+	}
+	if v, err := l.Load(ctx, "flaky"); err != nil || v != "FLAKY" {
+		t.Errorf("got %q, %v for the second load of flaky, want FLAKY", v, err)
+	}
+
+	// A batch is cancelled once every caller has stopped waiting for it.
+	before := runtime.NumGoroutine()
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.Load(cctx, "slow"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v for a load that timed out, want context.DeadlineExceeded", err)
+	}
+	checkGoroutines(t, before)
+
+	// The request waits for the batches of its slots, even those that gave up
+	// on them.
+	var stopped atomic.Bool
+	blocking := NewLoader(0, func(ctx context.Context, keys []string) (map[string]string, error) {
+		<-ctx.Done()
+		time.Sleep(20 * time.Millisecond)
+		stopped.Store(true)
+		return nil, ctx.Err()
+	})
+	s = New(templates.Page, WithMode(Buffered)).
+		Slot("a", func(ctx context.Context) (templ.Component, error) {
+			_, err := blocking.Load(ctx, "x")
+			return nil, err
+		}, WithTimeout(10*time.Millisecond))
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if !stopped.Load() {
+		t.Error("a batch outlived the request")
+	}
+
+	// A panicking batch fails its loads.
+	panicking := NewLoader(0, func(ctx context.Context, keys []string) (map[string]string, error) {
+		panic("boom")
+	})
+	var pe *PanicError
+	if _, err := panicking.Load(ctx, "x"); !errors.As(err, &pe) {
+		t.Errorf("got error %v from a panicking batch, want a *PanicError", err)
+	}
+
+	// Outside of a request, each key is loaded on its own.
+	reset()
+	for _, key := range []string{"x", "x"} {
+		if v, err := l.Load(context.Background(), key); err != nil || v != "X" {
+			t.Errorf("got %q, %v outside of a request, want X", v, err)
+		}
+	}
+	if got := reset(); !slices.Equal(got, []string{"x", "x"}) {
+		t.Errorf("got batches %q outside of a request, want two of x", got)
+	}
+}
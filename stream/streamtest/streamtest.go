@@ -0,0 +1,189 @@
+// Package streamtest records how a streaming handler flushes its response, so
+// that tests can check what reached the client, and when, rather than only the
+// final body that httptest.ResponseRecorder collapses it into.
+package streamtest
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/zackarysantana/goview/templates"
+)
+
+// Chunk is a part of the response that was flushed at once.
+type Chunk struct {
+	// At is when the chunk was flushed, relative to the start of the recording.
+	At   time.Duration
+	Body string
+	// Slots are the slots assigned in the chunk, in order.
+	Slots []string
+}
+
+// Assignment is a slot's contents arriving in the response. A list slot is
+// assigned once for each of its items.
+type Assignment struct {
+	Name string
+	// Chunk is the index of the chunk it arrived in.
+	Chunk int
+	At    time.Duration
+}
+
+// Recorder is an http.ResponseWriter that records each flushed chunk. Writes
+// after the last flush form a final chunk once Finish is called.
+//
+// The handler must write from a single goroutine at a time, as it would to a
+// real connection.
+type Recorder struct {
+	// Code is the status of the response. Informational responses, such as
+	// 103 Early Hints, are not recorded.
+	Code int
+	// SentHeader is the response's header as it was when the status was
+	// written.
+	SentHeader http.Header
+	Chunks     []Chunk
+
+	header  http.Header
+	started time.Time
+	wrote   bool
+	buf     bytes.Buffer
+}
+
+// NewRecorder returns an initialized Recorder whose clock starts now.
+func NewRecorder() *Recorder {
+	return &Recorder{Code: http.StatusOK, header: make(http.Header), started: time.Now()}
+}
+
+// Record serves r with h and returns its recording.
+func Record(h http.Handler, r *http.Request) *Recorder {
+	rec := NewRecorder()
+	h.ServeHTTP(rec, r)
+	rec.Finish()
+	return rec
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (rec *Recorder) WriteHeader(code int) {
+	if rec.wrote || code >= 100 && code <= 199 {
+		return
+	}
+	rec.wrote = true
+	rec.Code = code
+	rec.SentHeader = rec.header.Clone()
+}
+
+// Header implements http.ResponseWriter.
+func (rec *Recorder) Header() http.Header {
+	return rec.header
+}
+
+// Write implements http.ResponseWriter.
+func (rec *Recorder) Write(p []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.buf.Write(p)
+}
+
+// Flush implements http.Flusher, recording everything written since the last
+// flush as a chunk. Flushing nothing records nothing.
+func (rec *Recorder) Flush() {
+	rec.WriteHeader(http.StatusOK)
+	if rec.buf.Len() == 0 {
+		return
+	}
+	body := rec.buf.String()
+	rec.buf.Reset()
+	rec.Chunks = append(rec.Chunks, Chunk{At: time.Since(rec.started), Body: body, Slots: Slots(body)})
+}
+
+// Finish records whatever was written after the last flush, as the end of a
+// handler does.
+func (rec *Recorder) Finish() {
+	rec.Flush()
+}
+
+// Body returns the chunks joined together.
+func (rec *Recorder) Body() string {
+	var b bytes.Buffer
+	for _, c := range rec.Chunks {
+		b.WriteString(c.Body)
+	}
+	return b.String()
+}
+
+// Assignments returns every slot assignment, in the order they arrived.
+func (rec *Recorder) Assignments() []Assignment {
+	var as []Assignment
+	for i, c := range rec.Chunks {
+		for _, name := range c.Slots {
+			as = append(as, Assignment{Name: name, Chunk: i, At: c.At})
+		}
+	}
+	return as
+}
+
+// Arrival returns the first assignment of the named slot, and whether it
+// arrived at all.
+func (rec *Recorder) Arrival(name string) (Assignment, bool) {
+	as := rec.Assignments()
+	i := slices.IndexFunc(as, func(a Assignment) bool { return a.Name == name })
+	if i < 0 {
+		return Assignment{}, false
+	}
+	return as[i], true
+}
+
+// Order returns the names of the slots in the order they first arrived.
+func (rec *Recorder) Order() []string {
+	var names []string
+	for _, a := range rec.Assignments() {
+		if !slices.Contains(names, a.Name) {
+			names = append(names, a.Name)
+		}
+	}
+	return names
+}
+
+// Before reports whether slot a arrived in an earlier chunk than slot b. A
+// slot that never arrived comes after every other.
+func (rec *Recorder) Before(a, b string) bool {
+	aa, ok := rec.Arrival(a)
+	if !ok {
+		return false
+	}
+	ab, ok := rec.Arrival(b)
+	return !ok || aa.Chunk < ab.Chunk
+}
+
+// Shell returns the chunks flushed before the first slot arrived: the layout
+// and its placeholders.
+func (rec *Recorder) Shell() []Chunk {
+	for i, c := range rec.Chunks {
+		if len(c.Slots) > 0 {
+			return rec.Chunks[:i]
+		}
+	}
+	return rec.Chunks
+}
+
+// assignment matches the elements that carry a slot's contents: the light DOM
+// children of the shadow mode, and the hidden chunks of the script mode.
+var assignment = regexp.MustCompile(`<div slot="([^"]+)"|<div hidden id="slot-chunk-([^"]+)"`)
+
+// reserved are the names that the page's error summary and waterfall are
+// assigned to. Validate and Check reject slots registered under them, so no
+// real slot is left out.
+var reserved = []string{templates.ErrorsSlot, templates.DebugSlot}
+
+// Slots returns the names of the slots assigned in html, in order. The page's
+// error summary and waterfall share the markup of a slot, but are left out.
+func Slots(html string) []string {
+	var names []string
+	for _, m := range assignment.FindAllStringSubmatch(html, -1) {
+		if name := m[1] + m[2]; !slices.Contains(reserved, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
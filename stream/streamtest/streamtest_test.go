@@ -0,0 +1,119 @@
+package streamtest_test
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/zackarysantana/goview/stream"
+	"github.com/zackarysantana/goview/stream/streamtest"
+	"github.com/zackarysantana/goview/templates"
+)
+
+// after is a producer that returns c after d.
+func after(d time.Duration, c templ.Component) stream.Producer {
+	return func(ctx context.Context) (templ.Component, error) {
+		select {
+		case <-time.After(d):
+			return c, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	for _, m := range []stream.Mode{stream.Shadow, stream.Script} {
+		t.Run(m.String(), func(t *testing.T) {
+			s := stream.New(templates.Page, stream.WithMode(m), stream.WithEarlyHints()).
+				Slot("a", after(100*time.Millisecond, templates.A())).
+				Slot("c", after(0, templates.C())).
+				List("rows", func(ctx context.Context) iter.Seq2[templ.Component, error] {
+					return func(yield func(templ.Component, error) bool) {
+						for range 3 {
+							time.Sleep(10 * time.Millisecond)
+							if !yield(templates.Slot(1), nil) {
+								return
+							}
+						}
+					}
+				})
+			rec := streamtest.Record(s, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			// The early hints are not mistaken for the page's status.
+			if rec.Code != http.StatusOK {
+				t.Errorf("got status %d, want %d", rec.Code, http.StatusOK)
+			}
+			if len(rec.SentHeader.Values("Link")) == 0 {
+				t.Error("the Link headers were not recorded")
+			}
+
+			shell := rec.Shell()
+			if len(shell) == 0 || !strings.Contains(shell[0].Body, "<h1>Page</h1>") {
+				t.Fatalf("the shell was not flushed before any slot: %q", rec.Chunks)
+			}
+			if !rec.Before("c", "a") {
+				t.Errorf("slot c did not arrive before slot a: %q", rec.Order())
+			}
+			a, ok := rec.Arrival("a")
+			if !ok || a.At < 100*time.Millisecond {
+				t.Errorf("slot a arrived at %v, before it was produced", a.At)
+			}
+
+			// Each item of the list is flushed on its own.
+			var rows []streamtest.Assignment
+			for _, as := range rec.Assignments() {
+				if as.Name == "rows" {
+					rows = append(rows, as)
+				}
+			}
+			if len(rows) != 3 || rows[0].Chunk == rows[1].Chunk || rows[1].Chunk == rows[2].Chunk {
+				t.Errorf("got list items %+v, want 3 in separate chunks", rows)
+			}
+			if !strings.Contains(rec.Body(), "</html>") {
+				t.Errorf("the document was not finished:\n%s", rec.Body())
+			}
+		})
+	}
+
+	t.Run("failing slot", func(t *testing.T) {
+		s := stream.New(templates.Page, stream.WithWaterfall("debug")).
+			Slot("a", after(0, templates.A())).
+			Slot("f", func(ctx context.Context) (templ.Component, error) {
+				return nil, errors.New("f failed")
+			})
+		rec := streamtest.Record(s, httptest.NewRequest(http.MethodGet, "/?debug", nil))
+		if !strings.Contains(rec.Body(), `<div slot="goview-errors"`) || !strings.Contains(rec.Body(), `<div slot="goview-debug"`) {
+			t.Fatalf("the error summary or waterfall was not rendered:\n%s", rec.Body())
+		}
+		// The error summary and waterfall are not mistaken for slots.
+		if got := rec.Order(); len(got) != 2 || !slices.Contains(got, "a") || !slices.Contains(got, "f") {
+			t.Errorf("got slots %q, want a and f", got)
+		}
+	})
+
+	t.Run("buffered", func(t *testing.T) {
+		s := stream.New(templates.Page, stream.WithMode(stream.Buffered)).
+			Slot("a", after(0, templates.A()))
+		rec := streamtest.Record(s, httptest.NewRequest(http.MethodGet, "/", nil))
+		if len(rec.Chunks) != 1 || len(rec.Assignments()) != 0 {
+			t.Errorf("got %d chunks and assignments %+v, want the page in one chunk with none", len(rec.Chunks), rec.Assignments())
+		}
+	})
+}
+
+func TestSlots(t *testing.T) {
+	html := `<div><template shadowrootmode="open"><slot name="a"></slot></template></div>` +
+		`<div slot="b"><p>B</p></div><div hidden id="slot-chunk-c"><p>C</p></div><div slot="a">A</div>` +
+		`<div slot="goview-errors" class="text-red-500"></div><div slot="goview-debug"></div>`
+	if got, want := streamtest.Slots(html), []string{"b", "c", "a"}; !slices.Equal(got, want) {
+		t.Errorf("Slots() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,101 @@
+package stream
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zackarysantana/goview/templates"
+)
+
+// WithServerTiming sends a Server-Timing HTTP trailer with an entry for every
+// slot, as the headers have already been sent by the time slots resolve.
+func WithServerTiming() Option {
+	return func(s *Stream) {
+		s.serverTiming = true
+	}
+}
+
+// WithWaterfall renders a debug overlay showing when each slot started,
+// finished and was flushed, for requests with the query parameter param.
+func WithWaterfall(param string) Option {
+	return func(s *Stream) {
+		s.waterfallParam = param
+	}
+}
+
+// timing records when a slot started, finished and was flushed, relative to
+// the start of the request. Unset times are zero.
+type timing struct {
+	name     string
+	started  time.Duration
+	finished time.Duration
+	flushed  time.Duration
+}
+
+// track starts recording the timing of the named slot.
+func (r *run) track(name string) *timing {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := &timing{name: name, started: time.Since(r.started)}
+	r.timings = append(r.timings, t)
+	return t
+}
+
+// mark sets *at to the time since the start of the request.
+func (r *run) mark(at *time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*at = time.Since(r.started)
+}
+
+// waterfall returns a row for every tracked slot.
+func (r *run) waterfall() []templates.WaterfallRow {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rows := make([]templates.WaterfallRow, len(r.timings))
+	for i, t := range r.timings {
+		rows[i] = templates.WaterfallRow{
+			Name:     t.name,
+			Started:  t.started,
+			Finished: t.finished,
+			Flushed:  t.flushed,
+		}
+	}
+	return rows
+}
+
+// serverTiming formats a Server-Timing header value, with the time to first
+// byte as "shell" and an entry per slot whose duration is the time until it was
+// flushed.
+func (r *run) serverTiming() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := []string{fmt.Sprintf("shell;dur=%s", ms(r.firstByte))}
+	for _, t := range r.timings {
+		entries = append(entries, fmt.Sprintf("%s;dur=%s;desc=%q",
+			timingName(t.name), ms(t.flushed),
+			fmt.Sprintf("%s started %sms, finished %sms", t.name, ms(t.started), ms(t.finished))))
+	}
+	return strings.Join(entries, ", ")
+}
+
+// timingName turns a slot name into a Server-Timing metric name.
+func timingName(name string) string {
+	return "slot-" + strings.Map(func(r rune) rune {
+		if r < 0x80 && (r == '-' || r == '_' || r == '.' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.1f", float64(d)/float64(time.Millisecond))
+}
+
+// showWaterfall reports whether r asked for the debug overlay.
+func (s *Stream) showWaterfall(r *http.Request) bool {
+	return s.waterfallParam != "" && r.URL.Query().Has(s.waterfallParam)
+}